@@ -0,0 +1,146 @@
+package actions
+
+import (
+	"coke/internal/policy"
+	"coke/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate"
+	"github.com/gobuffalo/validate/validators"
+)
+
+var errLastAdmin = errors.New("the last active admin can not be demoted, suspended or removed")
+
+type accessLevelJson struct {
+	AccessLevel int    `json:"access_level"`
+	Reason      string `json:"reason"`
+}
+
+// UpdateAccessLevel moves a user to another access level. Every change is
+// recorded together with the caller who made it. The level applies across
+// organizations, so users who belong to others are refused.
+func (u UserResource) UpdateAccessLevel(c buffalo.Context) error {
+	user := &models.User{}
+	err := models.DB.Scope(scopeUsers(c)).Find(user, c.Param("user_id"))
+	if err != nil {
+		return err
+	}
+
+	req := &accessLevelJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	verr := validate.Validate(
+		&validators.IntIsGreaterThan{Name: "access_level", Field: req.AccessLevel, Compared: 0},
+		&validators.IntIsLessThan{Name: "access_level", Field: req.AccessLevel, Compared: policy.TopLevel + 1},
+		&validators.StringLengthInRange{Name: "reason", Field: req.Reason, Min: 0, Max: 255},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	if !HasScope(c, policy.UpdateUser) {
+		return forbidden(c, fmt.Errorf("API key is missing the %s scope", policy.UpdateUser))
+	}
+	auth := c.Value("auth").(*models.User)
+	if err := policy.CanChangeAccessLevel(auth, user, req.AccessLevel); err != nil {
+		return forbidden(c, err)
+	}
+	owned, err := accountOwned(c, user)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return forbidden(c, errSharedAccount)
+	}
+
+	if user.AccessLevel.Valid && user.AccessLevel.Int == req.AccessLevel {
+		return c.Render(http.StatusOK, r.JSON(Response{
+			Data:   user,
+			Status: "ok",
+		}))
+	}
+
+	org := currentOrganization(c)
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		if err := keepTopAdmin(tx, org, user); err != nil {
+			return err
+		}
+
+		return user.SetAccessLevel(tx, req.AccessLevel, auth, org, req.Reason)
+	})
+	if errors.Is(err, errLastAdmin) {
+		return lastAdmin(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   user,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// keepTopAdmin returns errLastAdmin when demoting, suspending or removing
+// the user would leave the organization, or the app outside of one,
+// without an active top level admin. A locked admin still has a session
+// but does not count.
+func keepTopAdmin(tx *pop.Connection, org *models.Organization, user *models.User) error {
+	if user.AccessLevel.Int != policy.TopLevel {
+		return nil
+	}
+
+	others, err := otherTopAdmins(tx, org, user)
+	if err != nil {
+		return err
+	}
+	if len(others) == 0 {
+		return errLastAdmin
+	}
+
+	return nil
+}
+
+func lastAdmin(c buffalo.Context) error {
+	return c.Render(http.StatusConflict, r.JSON(Response{
+		Errors: "The last active admin can not be demoted, suspended or removed",
+		Status: "error",
+	}))
+}
+
+// otherTopAdmins returns the ids of the other live and active top level
+// admins of the organization, or of the whole app outside of one. The rows
+// stay locked until tx ends, so two admins can not demote each other at
+// once.
+func otherTopAdmins(tx *pop.Connection, org *models.Organization, user *models.User) ([]int, error) {
+	active, args := models.StatusCondition(models.StatusActive, time.Now())
+	ids := []int{}
+	q := tx.RawQuery(
+		"SELECT id FROM users WHERE access_level = ? AND deleted_at IS NULL AND id != ? AND "+active+" FOR UPDATE",
+		append([]interface{}{policy.TopLevel, user.ID}, args...)...,
+	)
+	if org != nil {
+		q = tx.RawQuery(
+			`SELECT users.id FROM users
+			JOIN memberships ON memberships.user_id = users.id
+			WHERE memberships.organization_id = ? AND users.access_level = ? AND users.deleted_at IS NULL AND users.id != ?
+			AND `+active+` FOR UPDATE`,
+			append([]interface{}{org.ID, policy.TopLevel, user.ID}, args...)...,
+		)
+	}
+
+	err := q.All(&ids)
+	return ids, err
+}
@@ -0,0 +1,119 @@
+package actions
+
+import (
+	"coke/models"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/nulls"
+)
+
+func (as *ActionSuite) changeAccessLevel(token string, id, level int) int {
+	req := as.JSON("/users/%d/access-level", id)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Put(map[string]interface{}{"access_level": level, "reason": "promotion"})
+	return res.Result().StatusCode
+}
+
+func (as *ActionSuite) Test_Users_Access_Level() {
+	token, err := Login(as)
+	as.NoError(err)
+	member, _ := as.newUserWithLevel("member@mail.com", 1)
+	manager, managerToken := as.newUserWithLevel("manager@mail.com", 3)
+	peer, _ := as.newUserWithLevel("peer@mail.com", 3)
+
+	as.Equal(http.StatusOK, as.changeAccessLevel(token, member.ID, 2))
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, member.ID))
+	as.Equal(2, user.AccessLevel.Int)
+
+	change := &models.AccessLevelChange{}
+	as.NoError(as.DB.Where("user_id = ?", member.ID).First(change))
+	as.Equal(UserAdmin.ID, change.ChangedBy.Int)
+	as.Equal(Organization.ID, change.OrganizationID.Int)
+	as.Equal(1, change.FromLevel.Int)
+	as.Equal(2, change.ToLevel)
+	as.Equal("promotion", change.Reason.String)
+
+	membership := &models.Membership{}
+	as.NoError(as.DB.Where("organization_id = ? AND user_id = ?", Organization.ID, member.ID).First(membership))
+	role := &models.Role{}
+	as.NoError(as.DB.Find(role, membership.RoleID))
+	as.Equal("viewer", role.Name)
+
+	// Nobody can grant their own level or above.
+	as.Equal(http.StatusForbidden, as.changeAccessLevel(managerToken, member.ID, 3))
+	as.Equal(http.StatusForbidden, as.changeAccessLevel(token, member.ID, 4))
+	// Nor change a peer's or their own.
+	as.Equal(http.StatusForbidden, as.changeAccessLevel(managerToken, peer.ID, 1))
+	as.Equal(http.StatusForbidden, as.changeAccessLevel(managerToken, manager.ID, 1))
+	as.Equal(http.StatusOK, as.changeAccessLevel(managerToken, member.ID, 1))
+
+	as.Equal(http.StatusUnprocessableEntity, as.changeAccessLevel(token, member.ID, 5))
+
+	count, err := as.DB.Where("user_id = ?", member.ID).Count(&models.AccessLevelChanges{})
+	as.NoError(err)
+	as.Equal(2, count)
+}
+
+func (as *ActionSuite) Test_Users_Access_Level_Top_Admins() {
+	token, err := Login(as)
+	as.NoError(err)
+	admin, _ := as.newUserWithLevel("admin2@mail.com", 4)
+	as.newOtherOrganization()
+
+	others, err := otherTopAdmins(as.DB, Organization, admin)
+	as.NoError(err)
+	as.Equal([]int{UserAdmin.ID}, others)
+
+	// Top level admins manage each other.
+	as.Equal(http.StatusOK, as.changeAccessLevel(token, admin.ID, 3))
+
+	others, err = otherTopAdmins(as.DB, Organization, UserAdmin)
+	as.NoError(err)
+	as.Empty(others)
+}
+
+func (as *ActionSuite) Test_Users_Last_Active_Admin() {
+	token, err := Login(as)
+	as.NoError(err)
+	admin, _ := as.newUserWithLevel("admin2@mail.com", 4)
+
+	// A locked admin keeps their session, but can not take the last active
+	// admin away.
+	as.NoError(UserAdmin.SetStatus(as.DB, models.StatusLocked, "Too many failed sign in attempts", nulls.NewTime(time.Now().Add(time.Hour))))
+
+	as.Equal(http.StatusConflict, as.changeAccessLevel(token, admin.ID, 3))
+	as.Equal(http.StatusConflict, as.setStatus(token, admin.ID, "suspend", map[string]interface{}{"reason": "spam"}))
+
+	req := as.JSON("/users/%d", admin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	as.Equal(http.StatusConflict, req.Delete().Result().StatusCode)
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, admin.ID))
+	as.Equal(4, user.AccessLevel.Int)
+	as.Equal(models.StatusActive, user.Status)
+	as.False(user.DeletedAt.Valid)
+
+	// Once the lock lifts there are two again.
+	as.NoError(UserAdmin.SetStatus(as.DB, models.StatusActive, "", nulls.Time{}))
+	as.Equal(http.StatusOK, as.changeAccessLevel(token, admin.ID, 3))
+}
+
+func (as *ActionSuite) Test_Users_Access_Level_Shared_Account() {
+	token, err := Login(as)
+	as.NoError(err)
+	member, _ := as.newUserWithLevel("member@mail.com", 1)
+	other, _ := as.newOtherOrganization()
+	as.NoError(models.AddMember(as.DB, other.ID, member))
+
+	// The level would change what the member may do in the other one too.
+	as.Equal(http.StatusForbidden, as.changeAccessLevel(token, member.ID, 2))
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, member.ID))
+	as.Equal(1, user.AccessLevel.Int)
+}
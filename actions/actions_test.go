@@ -2,15 +2,13 @@ package actions
 
 import (
 	"coke/internal/cache"
+	"coke/mailers"
 	"coke/models"
 	"os"
 	"testing"
-	"time"
 
-	"github.com/gobuffalo/envy"
 	"github.com/gobuffalo/nulls"
 	"github.com/gobuffalo/suite/v4"
-	"github.com/golang-jwt/jwt/v4"
 )
 
 type ActionSuite struct {
@@ -19,6 +17,11 @@ type ActionSuite struct {
 
 var UserAdmin *models.User
 
+// Organization is the organization NewAdmin belongs to.
+var Organization *models.Organization
+
+var Outbox *mailers.Outbox
+
 func Test_ActionSuite(t *testing.T) {
 	action, err := suite.NewActionWithFixtures(App(), os.DirFS("../fixtures"))
 	if err != nil {
@@ -31,9 +34,22 @@ func Test_ActionSuite(t *testing.T) {
 
 	cache.NewCache(as.App.Name)
 
+	Outbox = mailers.NewOutbox(t.TempDir())
+	mailers.Default = Outbox
+
 	suite.Run(t, as)
 }
 
+func (as *ActionSuite) SetupTest() {
+	as.Action.SetupTest()
+	cache.Cache.Flush()
+	as.NoError(Outbox.Clear())
+	as.NoError(models.SeedRoles(as.DB))
+
+	Organization = &models.Organization{Name: "Test", Slug: "test"}
+	as.NoError(as.DB.Create(Organization))
+}
+
 func NewAdmin(as *ActionSuite) error {
 	user := &models.User{
 		Name:        "admin",
@@ -47,6 +63,11 @@ func NewAdmin(as *ActionSuite) error {
 		return err
 	}
 
+	err = models.AddMember(as.DB, Organization.ID, user)
+	if err != nil {
+		return err
+	}
+
 	UserAdmin = user
 
 	return nil
@@ -58,14 +79,5 @@ func Login(as *ActionSuite) (ts string, err error) {
 		as.T().Fatal("failed creating new User Admin")
 	}
 
-	claims := jwt.MapClaims{}
-	claims["user_id"] = UserAdmin.ID
-	claims["exp"] = time.Now().Add(7 * 24 * time.Hour).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(envy.Get("JWT_SECRET", "")))
-	if err != nil {
-		return "", err
-	}
-
-	return tokenString, nil
+	return newAccessToken(UserAdmin)
 }
@@ -0,0 +1,151 @@
+package actions
+
+import (
+	"coke/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+)
+
+// KnownScopes lists every scope an API key can be granted.
+var KnownScopes = []string{"users:read", "users:create", "users:update", "users:delete"}
+
+var errSessionRequired = errors.New("this action requires a login session, not an API key")
+
+type APIKeyResource struct{}
+
+type apiKeyJson struct {
+	Name      string     `json:"name"`
+	Scopes    []string   `json:"scopes"`
+	ExpiresAt nulls.Time `json:"expires_at"`
+}
+
+type createdAPIKey struct {
+	*models.APIKey
+	Token string `json:"token"`
+}
+
+// Index lists the caller's API keys that have not been revoked.
+func (a APIKeyResource) Index(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	auth := c.Value("auth").(*models.User)
+	keys := &models.APIKeys{}
+	err := models.DB.Where("user_id = ? AND revoked_at IS NULL", auth.ID).Order("created_at desc").All(keys)
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   keys,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// Store creates an API key. The key is only ever returned by this call.
+func (a APIKeyResource) Store(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	req := &apiKeyJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	verr := validate.Validate(
+		&validators.StringIsPresent{Name: "name", Field: req.Name},
+		&validators.StringLengthInRange{Name: "name", Field: req.Name, Min: 1, Max: 100},
+	)
+	if len(req.Scopes) == 0 {
+		verr.Add("scopes", "At least one scope must be granted.")
+	}
+	for _, scope := range req.Scopes {
+		if !knownScope(scope) {
+			verr.Add("scopes", fmt.Sprintf("%s is not a known scope.", scope))
+		}
+	}
+	if req.ExpiresAt.Valid && !req.ExpiresAt.Time.After(time.Now()) {
+		verr.Add("expires_at", "Expiry must be in the future.")
+	}
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	auth := c.Value("auth").(*models.User)
+	key, apiKey, err := models.NewAPIKey(auth.ID, req.Name, req.Scopes, req.ExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	err = models.DB.Create(apiKey)
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   createdAPIKey{APIKey: apiKey, Token: key},
+		Status: "ok",
+	}
+	return c.Render(http.StatusCreated, r.JSON(response))
+}
+
+// Delete revokes one of the caller's API keys.
+func (a APIKeyResource) Delete(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	auth := c.Value("auth").(*models.User)
+	key := &models.APIKey{}
+	err := models.DB.Where("user_id = ? AND revoked_at IS NULL", auth.ID).Find(key, c.Param("token_id"))
+	if err != nil {
+		return err
+	}
+
+	key.RevokedAt = nulls.NewTime(time.Now())
+	err = models.DB.UpdateColumns(key, "revoked_at")
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusNoContent, nil)
+}
+
+// HasScope reports whether the credential of the request carries scope.
+func HasScope(c buffalo.Context, scope string) bool {
+	key, ok := c.Value("api_key").(*models.APIKey)
+	if !ok {
+		return true
+	}
+
+	return key.HasScope(scope)
+}
+
+func usingAPIKey(c buffalo.Context) bool {
+	_, ok := c.Value("api_key").(*models.APIKey)
+	return ok
+}
+
+func knownScope(scope string) bool {
+	for _, s := range KnownScopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
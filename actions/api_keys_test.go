@@ -0,0 +1,92 @@
+package actions
+
+import (
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+func (as *ActionSuite) createAPIKey(token string, scopes ...string) createdAPIKey {
+	req := as.JSON("/me/tokens")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(&apiKeyJson{Name: "ci", Scopes: scopes})
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+
+	var created struct {
+		Data createdAPIKey `json:"data"`
+	}
+	err := json.Unmarshal(res.Body.Bytes(), &created)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+
+	return created.Data
+}
+
+func (as *ActionSuite) Test_APIKeys_Authenticate_With_Scopes() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	key := as.createAPIKey(token, "users:read")
+	as.Contains(key.Token, models.APIKeyPrefix)
+
+	req := as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", key.Token)
+	res := req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	req = as.JSON("/users/%d", UserAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", key.Token)
+	res = req.Put(&models.User{Name: "renamed", Email: UserAdmin.Email})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+
+	req = as.JSON("/me/tokens")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", key.Token)
+	res = req.Post(&apiKeyJson{Name: "escalated", Scopes: KnownScopes})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+
+	stored := &models.APIKey{}
+	err = as.DB.Find(stored, key.ID)
+	as.NoError(err)
+	as.True(stored.LastUsedAt.Valid)
+}
+
+func (as *ActionSuite) Test_APIKeys_Validation() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	req := as.JSON("/me/tokens")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(&apiKeyJson{Name: "ci", Scopes: []string{"users:everything"}})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_APIKeys_Revoke() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	key := as.createAPIKey(token, "users:read")
+
+	req := as.JSON("/me/tokens")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	as.NotContains(res.Body.String(), key.Token)
+
+	req = as.JSON("/me/tokens/%d", key.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Delete()
+	as.Equal(http.StatusNoContent, res.Result().StatusCode)
+
+	req = as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", key.Token)
+	res = req.Get()
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+}
@@ -1,9 +1,19 @@
 package actions
 
 import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"coke/internal/keys"
+	"coke/internal/revocation"
+	"coke/internal/secretbox"
 	"coke/models"
 
 	"github.com/gobuffalo/buffalo"
@@ -11,8 +21,7 @@ import (
 	contenttype "github.com/gobuffalo/mw-contenttype"
 	forcessl "github.com/gobuffalo/mw-forcessl"
 	paramlogger "github.com/gobuffalo/mw-paramlogger"
-	tokenauth "github.com/gobuffalo/mw-tokenauth"
-	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/nulls"
 	"github.com/gobuffalo/x/sessions"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/rs/cors"
@@ -20,10 +29,12 @@ import (
 )
 
 type Response struct {
-	Data   interface{}    `json:"data"`
-	Errors interface{}    `json:"errors"`
-	Status string         `json:"status"`
-	Meta   *pop.Paginator `json:"meta"`
+	Data   interface{} `json:"data"`
+	Errors interface{} `json:"errors"`
+	Status string      `json:"status"`
+	Meta   interface{} `json:"meta"`
+	// Code identifies errors that clients need to tell apart.
+	Code string `json:"code,omitempty"`
 }
 
 // ENV is used to help switch settings based on where the
@@ -35,6 +46,12 @@ var (
 	appOnce sync.Once
 )
 
+// Keys signs new access tokens and verifies incoming ones.
+var Keys *keys.Set
+
+// TOTPSecrets encrypts the TOTP secrets stored for two-factor sign in.
+var TOTPSecrets *secretbox.Box
+
 // App is where all routes and middleware for buffalo
 // should be defined. This is the nerve center of your
 // application.
@@ -50,6 +67,24 @@ var (
 // declared after it to never be called.
 func App() *buffalo.App {
 	appOnce.Do(func() {
+		var err error
+		Keys, err = loadKeys()
+		if err != nil {
+			log.Fatal(err)
+		}
+		TOTPSecrets, err = loadTOTPSecrets()
+		if err != nil {
+			log.Fatal(err)
+		}
+		CursorSecret, err = loadCursorSecret()
+		if err != nil {
+			log.Fatal(err)
+		}
+		IdentityProviders, err = loadIdentityProviders()
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		app = buffalo.New(buffalo.Options{
 			Env:          ENV,
 			SessionStore: sessions.Null{},
@@ -74,20 +109,75 @@ func App() *buffalo.App {
 		// Remove to disable this.
 		// app.Use(popmw.Transaction(models.DB))
 		app.GET("/", HomeHandler)
+		app.GET("/.well-known/jwks.json", JWKSIndex)
 
 		app.Use(AuthJwt())
 		app.Use(SetCurrentUser)
-		app.Middleware.Skip(AuthJwt(), AuthCreate)
+		app.Use(RequireTwoFactor)
+		app.Use(Idempotency)
+		app.Middleware.Skip(AuthJwt(),
+			JWKSIndex, AuthCreate, AuthRefresh, TwoFactorVerify,
+			PasswordForgot, PasswordReset, AuthVerify, AuthRegister,
+			OIDCStart, OIDCCallback, InvitationAccept,
+		)
+		app.Middleware.Skip(RequireTwoFactor, AuthIndex, AuthDelete, TwoFactorSetup, TwoFactorConfirm)
+		// Responses that carry secrets are never stored for replay.
+		app.Middleware.Skip(Idempotency, MePassword, APIKeyResource{}.Store, TwoFactorSetup, TwoFactorConfirm)
+		// PATCH picks the patch format from the Content-Type sent by the client.
+		app.Middleware.Skip(contenttype.Set("application/json"), UserResource{}.Patch)
 
+		// Users may show and update their own record without a permission,
+		// so those checks are left to the users policy.
 		ur := UserResource{}
-		app.GET("/users", ur.Index)
+		app.GET("/users", RequirePermission("users:read")(ur.Index))
+		app.GET("/users/export", RequirePermission("users:read")(ur.Export))
+		app.POST("/users/import", RequirePermission("users:create")(ur.Import))
 		app.GET("/users/{user_id}", ur.Show)
-		app.POST("/users", ur.Store)
+		app.POST("/users", RequirePermission("users:create")(ur.Store))
+		app.POST("/users/bulk", ur.Bulk)
 		app.PUT("/users/{user_id}", ur.Update)
-		app.DELETE("/users/{user_id}", ur.Delete)
+		app.PATCH("/users/{user_id}", ur.Patch)
+		app.DELETE("/users/{user_id}", RequirePermission("users:delete")(ur.Delete))
+		app.POST("/users/{user_id}/restore", RequirePermission("users:delete")(ur.Restore))
+		app.PUT("/users/{user_id}/access-level", RequirePermission("users:update")(ur.UpdateAccessLevel))
+		app.POST("/users/{user_id}/suspend", RequirePermission("users:update")(ur.Suspend))
+		app.POST("/users/{user_id}/reactivate", RequirePermission("users:update")(ur.Reactivate))
+
+		app.GET("/me", MeShow)
+		app.PATCH("/me", MeUpdate)
+		app.POST("/me/password", MePassword)
+
+		orgr := OrganizationResource{}
+		app.GET("/organizations", orgr.Index)
+		app.POST("/organizations", orgr.Store)
+
+		ir := InvitationResource{}
+		app.GET("/invitations", RequirePermission("users:create")(ir.Index))
+		app.POST("/invitations", RequirePermission("users:create")(ir.Store))
+		app.POST("/invitations/{invitation_id}/resend", RequirePermission("users:create")(ir.Resend))
+		app.DELETE("/invitations/{invitation_id}", RequirePermission("users:create")(ir.Delete))
+		app.POST("/invitations/{token}/accept", InvitationAccept)
+
+		akr := APIKeyResource{}
+		app.GET("/me/tokens", akr.Index)
+		app.POST("/me/tokens", akr.Store)
+		app.DELETE("/me/tokens/{token_id}", akr.Delete)
 
 		app.POST("/auth", AuthCreate)
 		app.GET("/auth", AuthIndex)
+		app.DELETE("/auth", AuthDelete)
+		app.POST("/auth/refresh", AuthRefresh)
+		app.POST("/auth/register", AuthRegister)
+		app.GET("/auth/oidc/{provider}/start", OIDCStart)
+		app.GET("/auth/oidc/{provider}/callback", OIDCCallback)
+		app.POST("/auth/2fa/setup", TwoFactorSetup)
+		app.POST("/auth/2fa/confirm", TwoFactorConfirm)
+		app.POST("/auth/2fa/verify", TwoFactorVerify)
+		app.DELETE("/auth/2fa", TwoFactorDelete)
+		app.POST("/auth/password/forgot", PasswordForgot)
+		app.POST("/auth/password/reset", PasswordReset)
+		app.POST("/auth/verify", AuthVerify)
+		app.POST("/auth/verify/resend", AuthVerifyResend)
 
 	})
 
@@ -106,21 +196,121 @@ func forceSSL() buffalo.MiddlewareFunc {
 	})
 }
 
+// loadKeys reads the signing keys from JWT_KEYS_DIR. Keys can be retired
+// through JWT_RETIRED_KIDS and the signer pinned with JWT_SIGNING_KID.
+// Outside production a missing key directory falls back to a throwaway key.
+func loadKeys() (*keys.Set, error) {
+	dir := envy.Get("JWT_KEYS_DIR", "keys")
+	if _, err := os.Stat(dir); errors.Is(err, os.ErrNotExist) && ENV != "production" {
+		log.Printf("key directory %q not found, signing with an ephemeral key", dir)
+		return keys.Ephemeral()
+	}
+
+	var retired []string
+	if v := envy.Get("JWT_RETIRED_KIDS", ""); v != "" {
+		retired = strings.Split(v, ",")
+	}
+
+	return keys.Load(dir, retired, envy.Get("JWT_SIGNING_KID", ""))
+}
+
+// loadTOTPSecrets reads the base64 encoded AES-256 key for TOTP secrets
+// from TOTP_ENCRYPTION_KEY. Outside production a missing key falls back to
+// a throwaway one, so enrollments do not survive a restart.
+func loadTOTPSecrets() (*secretbox.Box, error) {
+	key := envy.Get("TOTP_ENCRYPTION_KEY", "")
+	if key == "" && ENV != "production" {
+		log.Printf("TOTP_ENCRYPTION_KEY not set, sealing TOTP secrets with an ephemeral key")
+		return secretbox.Ephemeral()
+	}
+
+	return secretbox.Parse(key)
+}
+
+// AuthJwt verifies the bearer token against any active key in Keys and
+// sets its claims on the context. Bearer tokens that look like an API key
+// are looked up instead and set as "api_key".
 func AuthJwt() buffalo.MiddlewareFunc {
-	return tokenauth.New(tokenauth.Options{
-		SignMethod: jwt.SigningMethodHS256,
-	})
+	return func(next buffalo.Handler) buffalo.Handler {
+		return func(c buffalo.Context) error {
+			tokenString, err := getBearerToken(c.Request())
+			if err != nil {
+				return c.Error(http.StatusUnauthorized, err)
+			}
+
+			if strings.HasPrefix(tokenString, models.APIKeyPrefix) {
+				key, err := models.FindActiveAPIKey(models.DB, tokenString)
+				if err != nil {
+					return c.Error(http.StatusUnauthorized, errors.New("API key is invalid, expired or revoked"))
+				}
+
+				c.Set("api_key", key)
+				return next(c)
+			}
+
+			token, err := jwt.Parse(tokenString, Keys.Keyfunc)
+			if err != nil {
+				return c.Error(http.StatusUnauthorized, err)
+			}
+
+			c.Set("claims", token.Claims)
+			return next(c)
+		}
+	}
+}
+
+func getBearerToken(req *http.Request) (string, error) {
+	authString := req.Header.Get("Authorization")
+	if authString == "" {
+		return "", errors.New("token not found in request")
+	}
+
+	tokenString := strings.TrimPrefix(authString, "Bearer ")
+	if tokenString == authString || tokenString == "" {
+		return "", errors.New("token invalid")
+	}
+
+	return tokenString, nil
 }
 
 func SetCurrentUser(next buffalo.Handler) buffalo.Handler {
 	return func(c buffalo.Context) error {
 		user := &models.User{}
+		if key, ok := c.Value("api_key").(*models.APIKey); ok {
+			err := models.DB.Scope(models.NotDeleted).Find(user, key.UserID)
+			if err != nil {
+				return c.Render(401, r.JSON(Response{
+					Errors: "User no longer exists",
+				}))
+			}
+			if !user.KeepsSessions() {
+				return inactiveAccount(c, user)
+			}
+
+			// Recording every request would mean a write per call.
+			if !key.LastUsedAt.Valid || time.Since(key.LastUsedAt.Time) > time.Minute {
+				key.LastUsedAt = nulls.NewTime(time.Now())
+				err = models.DB.UpdateColumns(key, "last_used_at")
+				if err != nil {
+					return err
+				}
+			}
+
+			return authenticated(c, next, user)
+		}
+
 		cv := c.Value("claims")
 		if cv == nil {
 			return next(c)
 		}
 
 		claims := cv.(jwt.MapClaims)
+		if claims["typ"] != "access" {
+			return c.Render(401, r.JSON(Response{
+				Errors: "Token can not be used for this request",
+			}))
+		}
+
 		userId := claims["user_id"].(float64)
 		exp := int64(claims["exp"].(float64))
 
@@ -130,13 +320,77 @@ func SetCurrentUser(next buffalo.Handler) buffalo.Handler {
 			}))
 		}
 
-		err := models.DB.Find(user, userId)
-		if err == nil {
-			c.Set("auth", user)
+		if jti, ok := claims["jti"].(string); ok {
+			revoked, err := revocation.IsRevoked(jti)
+			if err != nil {
+				return err
+			}
+			if revoked {
+				return c.Render(401, r.JSON(Response{
+					Errors: "Token has been revoked",
+				}))
+			}
 		}
 
-		return next(c)
+		err := models.DB.Scope(models.NotDeleted).Find(user, userId)
+		if err != nil {
+			return c.Render(401, r.JSON(Response{
+				Errors: "User no longer exists",
+			}))
+		}
+
+		iat, _ := claims["iat"].(float64)
+		if user.TokenRevoked(time.Unix(int64(iat), 0)) {
+			return c.Render(401, r.JSON(Response{
+				Errors: "Token has been revoked",
+			}))
+		}
+		if !user.KeepsSessions() {
+			return inactiveAccount(c, user)
+		}
+		return authenticated(c, next, user)
+	}
+}
+
+// authenticated sets the current user and organization on the context.
+// The organization is only ever chosen with the X-Organization-ID header,
+// tokens are not tied to one; without the header it is the user's first
+// membership.
+func authenticated(c buffalo.Context, next buffalo.Handler, user *models.User) error {
+	orgID := 0
+	if header := c.Request().Header.Get("X-Organization-ID"); header != "" {
+		id, err := strconv.Atoi(header)
+		if err != nil {
+			return c.Render(http.StatusForbidden, r.JSON(Response{
+				Errors: "X-Organization-ID is not an organization id",
+				Status: "error",
+			}))
+		}
+		orgID = id
 	}
+
+	// Users without any membership act outside of an organization.
+	org, err := models.FindMemberOrganization(models.DB, user.ID, orgID)
+	if errors.Is(err, sql.ErrNoRows) && orgID != 0 {
+		return c.Render(http.StatusForbidden, r.JSON(Response{
+			Errors: "You are not a member of this organization",
+			Status: "error",
+		}))
+	}
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	if err := user.LoadPermissions(models.DB, org); err != nil {
+		return err
+	}
+
+	c.Set("auth", user)
+	if org != nil {
+		c.Set("organization", org)
+	}
+
+	return next(c)
 }
 
 func SetResponseHeader(next buffalo.Handler) buffalo.Handler {
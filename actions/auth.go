@@ -2,14 +2,19 @@ package actions
 
 import (
 	"coke/internal/cache"
+	"coke/internal/revocation"
+	"coke/internal/token"
 	"coke/models"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
 	"time"
 
 	"github.com/gobuffalo/buffalo"
-	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
 	"github.com/gobuffalo/validate/v3"
 	"github.com/gobuffalo/validate/v3/validators"
 	"github.com/golang-jwt/jwt/v4"
@@ -18,6 +23,17 @@ import (
 
 var MaxAttempts = 5
 
+// LockoutDuration is how long an account stays locked once MaxAttempts
+// sign ins have failed in a row.
+var LockoutDuration = 5 * time.Minute
+
+var (
+	// AccessTokenLifetime is how long a signed JWT is accepted.
+	AccessTokenLifetime = 15 * time.Minute
+	// RefreshTokenLifetime is how long a refresh token can be exchanged.
+	RefreshTokenLifetime = 30 * 24 * time.Hour
+)
+
 type credential struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
@@ -59,31 +75,236 @@ func AuthCreate(c buffalo.Context) error {
 	}
 
 	user := &models.User{}
-	err = models.DB.Where("email = (?)", credential.Email).First(user)
+	err = models.DB.Scope(models.NotDeleted).Where("email = (?)", credential.Email).First(user)
 	if err != nil {
 		return err
 	}
 
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credential.Password))
 	if err != nil {
-		cache.Cache.Add(getAttemptsCacheKey(credential.Email), 5*time.Minute, attempts+1)
+		cache.Cache.Add(getAttemptsCacheKey(credential.Email), LockoutDuration, attempts+1)
+		if attempts+1 >= MaxAttempts {
+			lockAccount(c, user)
+		}
 		return err
 	}
 
-	claims := jwt.MapClaims{}
-	claims["user_id"] = user.ID
-	claims["exp"] = time.Now().Add(7 * 24 * time.Hour).Unix()
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(envy.Get("JWT_SECRET", "")))
+	cache.Cache.Delete(getAttemptsCacheKey(user.Email))
+
+	if RequireVerifiedEmail && !user.VerifiedAt.Valid {
+		return c.Render(http.StatusForbidden, r.JSON(Response{
+			Errors: "Email address has not been verified",
+			Status: "error",
+		}))
+	}
+	return completeLogin(c, user)
+}
+
+// lockAccount locks an active user for LockoutDuration once MaxAttempts
+// sign ins have failed in a row.
+func lockAccount(c buffalo.Context, user *models.User) {
+	if !user.Active() {
+		return
+	}
+
+	err := user.SetStatus(models.DB, models.StatusLocked, "Too many failed sign in attempts", nulls.NewTime(time.Now().Add(LockoutDuration)))
 	if err != nil {
-		return err
+		c.Logger().Errorf("failed locking user: %v", err)
+	}
+}
+
+var errTooManyAttempts = errors.New("too many attempts")
+
+// verifyPassword checks a password the signed in user types again, such as
+// the current one before changing it. Failures count against the same
+// limit and lockout as sign ins, so a stolen access token can not be used
+// to guess the password. errTooManyAttempts is returned once the limit has
+// been reached.
+func verifyPassword(c buffalo.Context, user *models.User, password string) (bool, error) {
+	attempts := 0
+	res, err := cache.Cache.Value(getAttemptsCacheKey(user.Email))
+	if err == nil {
+		attempts = res.Data().(int)
+	}
+	if attempts >= MaxAttempts {
+		return false, errTooManyAttempts
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)) != nil {
+		cache.Cache.Add(getAttemptsCacheKey(user.Email), LockoutDuration, attempts+1)
+		if attempts+1 >= MaxAttempts {
+			lockAccount(c, user)
+		}
+		return false, nil
 	}
 
 	cache.Cache.Delete(getAttemptsCacheKey(user.Email))
+	return true, nil
+}
 
-	response := make(map[string]string)
-	response["token"] = tokenString
-	return c.Render(http.StatusOK, r.JSON(response))
+func tooManyAttempts(c buffalo.Context) error {
+	return c.Render(http.StatusTooManyRequests, r.JSON(Response{
+		Errors: "Too many attempts. Please try again later",
+		Status: "error",
+	}))
+}
+
+// inactiveAccount renders the refusal for a user whose status keeps them
+// from signing in. Each status has its own code so clients can tell them
+// apart.
+func inactiveAccount(c buffalo.Context, user *models.User) error {
+	response := Response{Status: "error", Code: "account_" + user.Status}
+	switch user.Status {
+	case models.StatusPending:
+		response.Errors = "Account has not been activated"
+	case models.StatusSuspended:
+		response.Errors = "Account has been suspended"
+	case models.StatusLocked:
+		response.Errors = "Account is locked"
+	default:
+		response.Errors = "Account is not active"
+		response.Code = "account_inactive"
+	}
+	if user.StatusUntil.Valid {
+		response.Meta = map[string]interface{}{"until": user.StatusUntil.Time}
+	}
+
+	return c.Render(http.StatusForbidden, r.JSON(response))
+}
+
+type refreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// AuthRefresh exchanges a refresh token for a new token pair. Every refresh
+// token is single use: presenting one that was already rotated revokes the
+// whole family, since either the client or an attacker holds a stolen copy.
+func AuthRefresh(c buffalo.Context) error {
+	req := &refreshRequest{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	verr := validate.Validate(
+		&validators.StringIsPresent{Name: "refresh_token", Field: req.RefreshToken},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	rt := &models.RefreshToken{}
+	err := models.DB.Where("token_hash = ?", token.Hash(req.RefreshToken)).First(rt)
+	if err != nil {
+		return c.Render(http.StatusUnauthorized, r.JSON(Response{
+			Errors: "Refresh token is invalid",
+			Status: "error",
+		}))
+	}
+
+	if rt.RevokedAt.Valid {
+		if err := rt.RevokeFamily(models.DB); err != nil {
+			return err
+		}
+		return c.Render(http.StatusUnauthorized, r.JSON(Response{
+			Errors: "Refresh token has been revoked",
+			Status: "error",
+		}))
+	}
+
+	if rt.IsExpired() {
+		return c.Render(http.StatusUnauthorized, r.JSON(Response{
+			Errors: "Refresh token is expired",
+			Status: "error",
+		}))
+	}
+
+	user := &models.User{}
+	err = models.DB.Scope(models.NotDeleted).Find(user, rt.UserID)
+	if err != nil {
+		return c.Render(http.StatusUnauthorized, r.JSON(Response{
+			Errors: "Refresh token is invalid",
+			Status: "error",
+		}))
+	}
+	if !user.KeepsSessions() {
+		return inactiveAccount(c, user)
+	}
+
+	var tokens *tokenPair
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		// Only one concurrent refresh may consume the token.
+		n, err := tx.RawQuery(
+			"UPDATE refresh_tokens SET revoked_at = ? WHERE id = ? AND revoked_at IS NULL",
+			time.Now(), rt.ID,
+		).ExecWithCount()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errRefreshTokenReused
+		}
+
+		tokens, err = issueTokens(tx, user, rt.FamilyID)
+		return err
+	})
+	if errors.Is(err, errRefreshTokenReused) {
+		if err := rt.RevokeFamily(models.DB); err != nil {
+			return err
+		}
+		return c.Render(http.StatusUnauthorized, r.JSON(Response{
+			Errors: "Refresh token has been revoked",
+			Status: "error",
+		}))
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, r.JSON(tokens))
+}
+
+type logoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// AuthDelete logs the caller out by revoking the access token used for this
+// request. When the refresh token is sent as well, its family is revoked too.
+func AuthDelete(c buffalo.Context) error {
+	req := &logoutRequest{}
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(req); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+	}
+
+	claims, _ := c.Value("claims").(jwt.MapClaims)
+	jti, _ := claims["jti"].(string)
+	if jti == "" {
+		return c.Error(http.StatusBadRequest, errors.New("token can not be revoked"))
+	}
+
+	exp := time.Unix(int64(claims["exp"].(float64)), 0)
+	err := revocation.Revoke(jti, exp)
+	if err != nil {
+		return err
+	}
+
+	if req.RefreshToken != "" {
+		auth := c.Value("auth").(*models.User)
+		rt := &models.RefreshToken{}
+		err = models.DB.Where("token_hash = ? AND user_id = ?", token.Hash(req.RefreshToken), auth.ID).First(rt)
+		if err == nil {
+			err = rt.RevokeFamily(models.DB)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return c.Render(http.StatusNoContent, nil)
 }
 
 func AuthIndex(c buffalo.Context) error {
@@ -97,3 +318,82 @@ func AuthIndex(c buffalo.Context) error {
 func getAttemptsCacheKey(email string) string {
 	return fmt.Sprintf("attempt:%s", email)
 }
+
+// getMFAAttemptsCacheKey counts failed second factor codes. A correct
+// password does not reset it, so signing in again buys no new guesses.
+func getMFAAttemptsCacheKey(userID int) string {
+	return fmt.Sprintf("mfa_attempt:%d", userID)
+}
+
+var errRefreshTokenReused = errors.New("refresh token reused")
+
+// startSession issues a token pair from a new refresh token family.
+func startSession(c buffalo.Context, user *models.User) error {
+	familyID, err := token.Generate(16)
+	if err != nil {
+		return err
+	}
+
+	var tokens *tokenPair
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		tokens, err = issueTokens(tx, user, familyID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, r.JSON(tokens))
+}
+
+type tokenPair struct {
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int64  `json:"expires_in"`
+}
+
+// issueTokens signs a new access token and stores a new refresh token in
+// the given family.
+func issueTokens(tx *pop.Connection, user *models.User, familyID string) (*tokenPair, error) {
+	accessToken, err := newAccessToken(user)
+	if err != nil {
+		return nil, err
+	}
+
+	refreshToken, err := token.Generate(32)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Create(&models.RefreshToken{
+		UserID:    user.ID,
+		TokenHash: token.Hash(refreshToken),
+		FamilyID:  familyID,
+		ExpiresAt: time.Now().Add(RefreshTokenLifetime),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &tokenPair{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int64(AccessTokenLifetime.Seconds()),
+	}, nil
+}
+
+func newAccessToken(user *models.User) (string, error) {
+	jti, err := token.Generate(16)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	claims["typ"] = "access"
+	claims["jti"] = jti
+	claims["user_id"] = user.ID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(AccessTokenLifetime).Unix()
+	return Keys.Sign(claims)
+}
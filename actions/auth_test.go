@@ -0,0 +1,147 @@
+package actions
+
+import (
+	"coke/internal/revocation"
+	"coke/internal/token"
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+func (as *ActionSuite) authenticate() tokenPair {
+	res := as.JSON("/auth").Post(&credential{
+		Email:    UserAdmin.Email,
+		Password: "password",
+	})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var tokens tokenPair
+	err := json.Unmarshal(res.Body.Bytes(), &tokens)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+
+	return tokens
+}
+
+func (as *ActionSuite) Test_Auth_Create() {
+	err := NewAdmin(as)
+	if err != nil {
+		as.T().Fatal("failed creating new User Admin")
+	}
+
+	tokens := as.authenticate()
+	as.NotEmpty(tokens.Token)
+	as.NotEmpty(tokens.RefreshToken)
+	as.Equal(int64(AccessTokenLifetime.Seconds()), tokens.ExpiresIn)
+
+	count, err := as.DB.Where("token_hash = ?", token.Hash(tokens.RefreshToken)).Count(&models.RefreshToken{})
+	if err != nil {
+		as.FailNow("error counting results", err)
+	}
+	as.Equal(1, count)
+}
+
+func (as *ActionSuite) Test_Auth_Refresh_Rotates() {
+	err := NewAdmin(as)
+	if err != nil {
+		as.T().Fatal("failed creating new User Admin")
+	}
+
+	tokens := as.authenticate()
+	res := as.JSON("/auth/refresh").Post(&refreshRequest{RefreshToken: tokens.RefreshToken})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var rotated tokenPair
+	err = json.Unmarshal(res.Body.Bytes(), &rotated)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+	as.NotEqual(tokens.RefreshToken, rotated.RefreshToken)
+
+	old := &models.RefreshToken{}
+	err = as.DB.Where("token_hash = ?", token.Hash(tokens.RefreshToken)).First(old)
+	if err != nil {
+		as.FailNow("failed finding records", err)
+	}
+	as.True(old.RevokedAt.Valid)
+}
+
+func (as *ActionSuite) Test_Auth_Refresh_Reuse_Revokes_Family() {
+	err := NewAdmin(as)
+	if err != nil {
+		as.T().Fatal("failed creating new User Admin")
+	}
+
+	tokens := as.authenticate()
+	res := as.JSON("/auth/refresh").Post(&refreshRequest{RefreshToken: tokens.RefreshToken})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var rotated tokenPair
+	err = json.Unmarshal(res.Body.Bytes(), &rotated)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+
+	res = as.JSON("/auth/refresh").Post(&refreshRequest{RefreshToken: tokens.RefreshToken})
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+
+	res = as.JSON("/auth/refresh").Post(&refreshRequest{RefreshToken: rotated.RefreshToken})
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Auth_Delete_Revokes_Token() {
+	err := NewAdmin(as)
+	if err != nil {
+		as.T().Fatal("failed creating new User Admin")
+	}
+
+	tokens := as.authenticate()
+	req := as.JSON("/auth")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", tokens.Token)
+	res := req.Delete()
+	as.Equal(http.StatusNoContent, res.Result().StatusCode)
+
+	req = as.JSON("/auth")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", tokens.Token)
+	res = req.Get()
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+
+	count, err := as.DB.Count(&models.RevokedToken{})
+	if err != nil {
+		as.FailNow("error counting results", err)
+	}
+	as.Equal(1, count)
+}
+
+func (as *ActionSuite) Test_Auth_Revoke_Twice() {
+	exp := time.Now().Add(time.Hour)
+	// Another logout with the same token already stored it.
+	as.NoError(as.DB.Create(&models.RevokedToken{JTI: "jti-1", ExpiresAt: exp}))
+
+	as.NoError(revocation.Revoke("jti-1", exp))
+	as.NoError(revocation.Revoke("jti-1", exp))
+
+	count, err := as.DB.Count(&models.RevokedToken{})
+	as.NoError(err)
+	as.Equal(1, count)
+}
+
+func (as *ActionSuite) Test_Auth_Deleted_User_Token_Rejected() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	err = as.DB.Destroy(UserAdmin)
+	if err != nil {
+		as.T().Fatal("failed deleting user")
+	}
+
+	req := as.JSON("/auth")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Get()
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+}
@@ -0,0 +1,282 @@
+package actions
+
+import (
+	"coke/internal/policy"
+	"coke/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// BulkMaxItems caps the number of operations in one bulk request.
+var BulkMaxItems = 500
+
+// Bulk modes. Atomic applies every operation or none of them; best effort
+// applies each operation that succeeds on its own.
+const (
+	BulkAtomic     = "atomic"
+	BulkBestEffort = "best_effort"
+)
+
+var (
+	errBulkRolledBack = errors.New("bulk request rolled back")
+	errBulkDryRun     = errors.New("bulk request is a dry run")
+)
+
+type bulkUpdate struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type bulkRequest struct {
+	Mode   string       `json:"mode"`
+	Create []userJson   `json:"create"`
+	Update []bulkUpdate `json:"update"`
+	Delete []int        `json:"delete"`
+}
+
+// bulkResult is the outcome of one operation, identified by its index in
+// the create, update or delete array of the request.
+type bulkResult struct {
+	Index  int         `json:"index"`
+	Status string      `json:"status"`
+	Data   interface{} `json:"data,omitempty"`
+	Errors interface{} `json:"errors,omitempty"`
+}
+
+type bulkMeta struct {
+	Mode      string `json:"mode"`
+	DryRun    bool   `json:"dry_run,omitempty"`
+	Succeeded int    `json:"succeeded"`
+	Failed    int    `json:"failed"`
+}
+
+// bulkOperation runs one operation on tx. after, when set, runs once the
+// operation has been committed.
+type bulkOperation func(tx *pop.Connection) (data interface{}, after func(), err error)
+
+// Bulk creates, updates and deletes users in one request. Every operation
+// goes through the same validation and policy checks as the single user
+// endpoints.
+func (u UserResource) Bulk(c buffalo.Context) error {
+	req := &bulkRequest{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	if req.Mode == "" {
+		req.Mode = BulkAtomic
+	}
+	verr := map[string][]string{}
+	if req.Mode != BulkAtomic && req.Mode != BulkBestEffort {
+		verr["mode"] = []string{fmt.Sprintf("Mode must be %s or %s", BulkAtomic, BulkBestEffort)}
+	}
+	if n := len(req.Create) + len(req.Update) + len(req.Delete); n == 0 {
+		verr["operations"] = []string{"At least one operation is required"}
+	} else if n > BulkMaxItems {
+		verr["operations"] = []string{fmt.Sprintf("At most %d operations are allowed", BulkMaxItems)}
+	}
+	if len(verr) > 0 {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: verr,
+			Status: "error",
+		}))
+	}
+
+	groups := []string{"create", "update", "delete"}
+	operations := map[string][]bulkOperation{}
+	for i := range req.Create {
+		operations["create"] = append(operations["create"], bulkCreate(c, &req.Create[i]))
+	}
+	for _, item := range req.Update {
+		operations["update"] = append(operations["update"], bulkChange(c, item))
+	}
+	for _, id := range req.Delete {
+		operations["delete"] = append(operations["delete"], bulkDelete(c, id))
+	}
+
+	results, meta, err := runBulk(req.Mode, false, groups, operations)
+	if errors.Is(err, errBulkRolledBack) {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Data:   results,
+			Errors: "No changes were saved because some operations failed",
+			Status: "error",
+			Meta:   meta,
+		}))
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, r.JSON(Response{
+		Data:   results,
+		Status: "ok",
+		Meta:   meta,
+	}))
+}
+
+// runBulk runs the operations of each group in order. A dry run applies
+// everything in one transaction that is always rolled back.
+func runBulk(mode string, dryRun bool, groups []string, operations map[string][]bulkOperation) (map[string][]bulkResult, *bulkMeta, error) {
+	results := map[string][]bulkResult{}
+	meta := &bulkMeta{Mode: mode, DryRun: dryRun}
+	after := []func(){}
+	run := func(tx *pop.Connection, group string, i int, op bulkOperation) error {
+		data, done, err := op(tx)
+		var uerr *userError
+		if errors.As(err, &uerr) {
+			results[group] = append(results[group], bulkResult{Index: i, Status: "error", Errors: uerr.errors})
+			meta.Failed++
+			return uerr
+		}
+		if err != nil {
+			return err
+		}
+
+		results[group] = append(results[group], bulkResult{Index: i, Status: "ok", Data: data})
+		meta.Succeeded++
+		if done != nil {
+			after = append(after, done)
+		}
+		return nil
+	}
+
+	if mode == BulkAtomic || dryRun {
+		err := models.DB.Transaction(func(tx *pop.Connection) error {
+			for _, group := range groups {
+				for i, op := range operations[group] {
+					err := run(tx, group, i, op)
+					var uerr *userError
+					if err != nil && !errors.As(err, &uerr) {
+						return err
+					}
+				}
+			}
+			if dryRun {
+				return errBulkDryRun
+			}
+			if meta.Failed > 0 {
+				return errBulkRolledBack
+			}
+			return nil
+		})
+		if errors.Is(err, errBulkDryRun) || errors.Is(err, errBulkRolledBack) {
+			// Nothing was saved, so records of successful operations are void.
+			for _, group := range groups {
+				for i := range results[group] {
+					if results[group][i].Status == "ok" {
+						results[group][i].Data = nil
+						if !dryRun {
+							results[group][i].Status = "rolled_back"
+						}
+					}
+				}
+			}
+			if !dryRun {
+				meta.Succeeded = 0
+				return results, meta, errBulkRolledBack
+			}
+			return results, meta, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	} else {
+		for _, group := range groups {
+			for i, op := range operations[group] {
+				err := models.DB.Transaction(func(tx *pop.Connection) error {
+					return run(tx, group, i, op)
+				})
+				var uerr *userError
+				if err != nil && !errors.As(err, &uerr) {
+					return nil, nil, err
+				}
+			}
+		}
+	}
+
+	for _, done := range after {
+		done()
+	}
+
+	return results, meta, nil
+}
+
+func bulkCreate(c buffalo.Context, req *userJson) bulkOperation {
+	return func(tx *pop.Connection) (interface{}, func(), error) {
+		user, err := createUser(c, tx, req)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		return user, func() {
+			err := requestEmailVerification(user, user.Email)
+			if err != nil {
+				c.Logger().Errorf("failed sending verification email: %v", err)
+			}
+		}, nil
+	}
+}
+
+func bulkChange(c buffalo.Context, item bulkUpdate) bulkOperation {
+	return func(tx *pop.Connection) (interface{}, func(), error) {
+		user, err := findBulkUser(c, tx, item.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if err := authorize(c, policy.UpdateUser, user); err != nil {
+			return nil, nil, &userError{http.StatusForbidden, err.Error()}
+		}
+
+		newEmail, err := changeUser(tx, user, item.Name, item.Email)
+		if err != nil || !newEmail {
+			return user, nil, err
+		}
+
+		return user, func() {
+			err := requestEmailVerification(user, item.Email)
+			if err != nil {
+				c.Logger().Errorf("failed sending verification email: %v", err)
+			}
+		}, nil
+	}
+}
+
+func bulkDelete(c buffalo.Context, id int) bulkOperation {
+	return func(tx *pop.Connection) (interface{}, func(), error) {
+		user, err := findBulkUser(c, tx, id)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		auth := c.Value("auth").(*models.User)
+		if auth.ID == user.ID {
+			return nil, nil, &userError{http.StatusBadRequest, "can not delete your own account"}
+		}
+
+		if err := authorize(c, policy.DeleteUser, user); err != nil {
+			return nil, nil, &userError{http.StatusForbidden, err.Error()}
+		}
+
+		return map[string]int{"id": user.ID}, nil, removeUser(c, tx, user)
+	}
+}
+
+func findBulkUser(c buffalo.Context, tx *pop.Connection, id int) (*models.User, error) {
+	user := &models.User{}
+	err := tx.Scope(scopeUsers(c)).Find(user, id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, &userError{http.StatusNotFound, fmt.Sprintf("user %d not found", id)}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
@@ -0,0 +1,123 @@
+package actions
+
+import (
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gobuffalo/nulls"
+)
+
+type bulkResponse struct {
+	Data   map[string][]bulkResult `json:"data"`
+	Status string                  `json:"status"`
+	Meta   bulkMeta                `json:"meta"`
+}
+
+func (as *ActionSuite) bulk(token string, body map[string]interface{}) (int, bulkResponse) {
+	req := as.JSON("/users/bulk")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(body)
+
+	response := bulkResponse{}
+	as.NoError(json.Unmarshal(res.Body.Bytes(), &response))
+	return res.Result().StatusCode, response
+}
+
+func newBulkUser(name string) map[string]interface{} {
+	return map[string]interface{}{
+		"name":                  name,
+		"email":                 name + "@mail.com",
+		"password":              "password",
+		"password_confirmation": "password",
+		"access_level":          1,
+	}
+}
+
+func (as *ActionSuite) Test_Users_Bulk_Atomic() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	existing := &models.User{Name: "existing", Email: "existing@mail.com", Password: "password", AccessLevel: nulls.NewInt(1)}
+	as.NoError(as.DB.Create(existing))
+	as.NoError(models.AddMember(as.DB, Organization.ID, existing))
+
+	// The second create repeats the first address, which only the
+	// transaction knows about.
+	code, res := as.bulk(token, map[string]interface{}{
+		"create": []interface{}{newBulkUser("alice"), newBulkUser("alice")},
+		"delete": []int{existing.ID},
+	})
+	as.Equal(http.StatusUnprocessableEntity, code)
+	as.Equal("error", res.Status)
+	as.Equal("rolled_back", res.Data["create"][0].Status)
+	as.Equal(1, res.Data["create"][1].Index)
+	as.Equal("error", res.Data["create"][1].Status)
+	as.Contains(res.Data["create"][1].Errors, "email")
+	as.Equal(bulkMeta{Mode: BulkAtomic, Succeeded: 0, Failed: 1}, res.Meta)
+
+	count, err := as.DB.Where("email = ?", "alice@mail.com").Count(&models.User{})
+	as.NoError(err)
+	as.Equal(0, count)
+	as.NoError(as.DB.Reload(existing))
+	as.False(existing.DeletedAt.Valid)
+
+	code, res = as.bulk(token, map[string]interface{}{
+		"create": []interface{}{newBulkUser("alice"), newBulkUser("bob")},
+		"update": []interface{}{map[string]interface{}{"id": existing.ID, "name": "renamed", "email": existing.Email}},
+		"delete": []int{existing.ID},
+	})
+	as.Equal(http.StatusOK, code)
+	as.Equal(bulkMeta{Mode: BulkAtomic, Succeeded: 4, Failed: 0}, res.Meta)
+
+	count, err = as.DB.Scope(models.MemberOf(Organization.ID)).Where("email IN (?, ?)", "alice@mail.com", "bob@mail.com").Count(&models.User{})
+	as.NoError(err)
+	as.Equal(2, count)
+	as.NoError(as.DB.Reload(existing))
+	as.Equal("renamed", existing.Name)
+	as.True(existing.DeletedAt.Valid)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 2)
+}
+
+func (as *ActionSuite) Test_Users_Bulk_Best_Effort() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	admin := newBulkUser("boss")
+	admin["access_level"] = 5
+	code, res := as.bulk(token, map[string]interface{}{
+		"mode":   BulkBestEffort,
+		"create": []interface{}{newBulkUser("alice"), admin},
+		"update": []interface{}{map[string]interface{}{"id": 999999, "name": "ghost", "email": "ghost@mail.com"}},
+		"delete": []int{UserAdmin.ID},
+	})
+	as.Equal(http.StatusOK, code)
+	as.Equal(bulkMeta{Mode: BulkBestEffort, Succeeded: 1, Failed: 3}, res.Meta)
+	as.Equal("ok", res.Data["create"][0].Status)
+	as.Equal("error", res.Data["create"][1].Status)
+	as.Equal("error", res.Data["update"][0].Status)
+	as.Equal("error", res.Data["delete"][0].Status)
+
+	count, err := as.DB.Where("email = ?", "alice@mail.com").Count(&models.User{})
+	as.NoError(err)
+	as.Equal(1, count)
+
+	// Callers without users:create get a per item refusal.
+	_, viewerToken := as.newUserWithLevel("viewer@mail.com", 2)
+	_, res = as.bulk(viewerToken, map[string]interface{}{
+		"mode":   BulkBestEffort,
+		"create": []interface{}{newBulkUser("carol")},
+	})
+	as.Equal("error", res.Data["create"][0].Status)
+
+	code, _ = as.bulk(token, map[string]interface{}{"mode": "sometimes"})
+	as.Equal(http.StatusUnprocessableEntity, code)
+}
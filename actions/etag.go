@@ -0,0 +1,87 @@
+package actions
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gobuffalo/buffalo"
+)
+
+// etag returns a strong entity tag for the JSON form of v. A record's tag
+// changes with its updated_at, and with any other change to its fields
+// even within the same second.
+func etag(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`, nil
+}
+
+// etagMatches reports whether an If-Match or If-None-Match header lists
+// tag. With weak set, as for If-None-Match, weak tags compare by their
+// opaque part; If-Match needs the strong comparison, which no weak tag
+// passes.
+func etagMatches(header, tag string, weak bool) bool {
+	for _, t := range strings.Split(header, ",") {
+		t = strings.TrimSpace(t)
+		if weak {
+			t = strings.TrimPrefix(t, "W/")
+		}
+		if t == "*" || t == tag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// renderWithETag renders a 200 tagged with the hash of v, or a bodyless
+// 304 when the client already holds that version.
+func renderWithETag(c buffalo.Context, v interface{}, response Response) error {
+	tag, err := etag(v)
+	if err != nil {
+		return err
+	}
+
+	c.Response().Header().Set("ETag", tag)
+	if match := c.Request().Header.Get("If-None-Match"); match != "" && etagMatches(match, tag, true) {
+		return c.Render(http.StatusNotModified, nil)
+	}
+
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// errPreconditionFailed means the If-Match header names a version that is
+// no longer current.
+var errPreconditionFailed = errors.New("the record has changed since it was fetched")
+
+// ifMatch reports whether the request's If-Match header matches the
+// current version of v. Requests without the header always match.
+func ifMatch(c buffalo.Context, v interface{}) (bool, error) {
+	match := c.Request().Header.Get("If-Match")
+	if match == "" {
+		return true, nil
+	}
+
+	tag, err := etag(v)
+	if err != nil {
+		return false, err
+	}
+
+	return etagMatches(match, tag, false), nil
+}
+
+// preconditionFailed renders the 412 for a failed If-Match.
+func preconditionFailed(c buffalo.Context) error {
+	return c.Render(http.StatusPreconditionFailed, r.JSON(Response{
+		Errors: "The record has changed since it was fetched",
+		Status: "error",
+	}))
+}
@@ -0,0 +1,229 @@
+package actions
+
+import (
+	"bytes"
+	"coke/internal/token"
+	"coke/models"
+	"database/sql"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/nulls"
+)
+
+// IdempotencyWindow is how long the first response to a request sent with
+// an Idempotency-Key header is replayed to retries.
+var IdempotencyWindow = time.Duration(envInt("IDEMPOTENCY_WINDOW_HOURS", 24)) * time.Hour
+
+// IdempotencyLease is how long a request holds its key before a retry may
+// presume it dead and run in its place.
+var IdempotencyLease = 5 * time.Minute
+
+// IdempotencyKeyMaxLength caps the length of an Idempotency-Key header.
+var IdempotencyKeyMaxLength = 255
+
+// responseRecorder keeps a copy of everything written to the response.
+type responseRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+// Idempotency makes mutating requests from signed in users safe to retry.
+// The first response to an Idempotency-Key is stored and replayed to every
+// retry with the same method, path and body; reusing the key for another
+// request is refused. Only successful responses are stored: after a 4xx
+// or 5xx the key is released, so a retry, or a corrected request under the
+// same key, runs for real. Keys belong to users, so anonymous requests
+// that send one are refused.
+func Idempotency(next buffalo.Handler) buffalo.Handler {
+	return func(c buffalo.Context) error {
+		req := c.Request()
+		key := req.Header.Get("Idempotency-Key")
+		auth, _ := c.Value("auth").(*models.User)
+		if key == "" || !mutating(req.Method) {
+			return next(c)
+		}
+		if auth == nil {
+			// Refused rather than ignored, so a client does not retry
+			// believing it is safe.
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+				Errors: "Idempotency-Key is only supported on requests from signed in users",
+				Status: "error",
+			}))
+		}
+		if len(key) > IdempotencyKeyMaxLength {
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+				Errors: "Idempotency-Key is too long",
+				Status: "error",
+			}))
+		}
+
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			return err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+		requestHash := idempotencyRequestHash(req, body)
+
+		record, claimed, err := claimIdempotencyKey(auth.ID, token.Hash(key), requestHash)
+		if err != nil {
+			return err
+		}
+		if record.RequestHash != requestHash {
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+				Errors: "Idempotency-Key has already been used for a different request",
+				Status: "error",
+			}))
+		}
+		if !claimed && !record.Done() {
+			return c.Render(http.StatusConflict, r.JSON(Response{
+				Errors: "A request with this Idempotency-Key is still being processed",
+				Status: "error",
+			}))
+		}
+		if record.Done() {
+			return replayResponse(c, record)
+		}
+
+		res, ok := c.Response().(*buffalo.Response)
+		if !ok {
+			releaseIdempotencyKey(c, record)
+			return next(c)
+		}
+		recorder := &responseRecorder{ResponseWriter: res.ResponseWriter}
+		res.ResponseWriter = recorder
+		stored := false
+		// Runs on panics too, so a crashed handler does not hold the key.
+		defer func() {
+			res.ResponseWriter = recorder.ResponseWriter
+			if !stored {
+				releaseIdempotencyKey(c, record)
+			}
+		}()
+
+		err = next(c)
+		if err != nil || res.Status >= http.StatusBadRequest {
+			return err
+		}
+
+		record.Status = res.Status
+		if record.Status == 0 {
+			record.Status = http.StatusOK
+		}
+		record.ContentType = nulls.NewString(res.Header().Get("Content-Type"))
+		record.Body = nulls.NewString(recorder.body.String())
+		err = models.DB.UpdateColumns(record, "status", "content_type", "body")
+		if err != nil {
+			c.Logger().Errorf("failed storing idempotent response: %v", err)
+			return nil
+		}
+		stored = true
+
+		return nil
+	}
+}
+
+func mutating(method string) bool {
+	switch method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		return true
+	}
+
+	return false
+}
+
+// idempotencyRequestHash identifies a request by its method, target,
+// content type and body.
+func idempotencyRequestHash(req *http.Request, body []byte) string {
+	return token.Hash(req.Method + " " + req.URL.RequestURI() + "\n" +
+		req.Header.Get("Content-Type") + "\n" + string(body))
+}
+
+// claimIdempotencyKey returns the live record for the key, or claims one
+// for this request, in which case claimed is true. An identical request
+// whose lease ran out is taken over.
+func claimIdempotencyKey(userID int, keyHash, requestHash string) (*models.IdempotencyKey, bool, error) {
+	find := func() (*models.IdempotencyKey, error) {
+		record := &models.IdempotencyKey{}
+		err := models.DB.Where("user_id = ? AND key_hash = ? AND expires_at > ?", userID, keyHash, time.Now()).First(record)
+		return record, err
+	}
+
+	record, err := find()
+	if err == nil {
+		if record.Done() || record.RequestHash != requestHash || record.LockedUntil.Time.After(time.Now()) {
+			return record, false, nil
+		}
+
+		// Only one retry may take over.
+		now := time.Now()
+		lease := now.Add(IdempotencyLease)
+		n, err := models.DB.RawQuery(
+			"UPDATE idempotency_keys SET locked_until = ? WHERE id = ? AND status = 0 AND (locked_until IS NULL OR locked_until <= ?)",
+			lease, record.ID, now,
+		).ExecWithCount()
+		if err != nil {
+			return nil, false, err
+		}
+		claimed := n == 1
+		if claimed {
+			record.LockedUntil = nulls.NewTime(lease)
+		}
+		return record, claimed, nil
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, false, err
+	}
+
+	// An expired record gives its key up.
+	err = models.DB.RawQuery(
+		"DELETE FROM idempotency_keys WHERE user_id = ? AND key_hash = ? AND expires_at <= ?",
+		userID, keyHash, time.Now(),
+	).Exec()
+	if err != nil {
+		return nil, false, err
+	}
+
+	record = &models.IdempotencyKey{
+		UserID:      userID,
+		KeyHash:     keyHash,
+		RequestHash: requestHash,
+		ExpiresAt:   time.Now().Add(IdempotencyWindow),
+		LockedUntil: nulls.NewTime(time.Now().Add(IdempotencyLease)),
+	}
+	if err := models.DB.Create(record); err != nil {
+		// A concurrent request with the same key got there first.
+		if existing, ferr := find(); ferr == nil {
+			return existing, false, nil
+		}
+		return nil, false, err
+	}
+
+	return record, true, nil
+}
+
+// releaseIdempotencyKey forgets a claim whose response is not kept.
+func releaseIdempotencyKey(c buffalo.Context, record *models.IdempotencyKey) {
+	if err := models.DB.Destroy(record); err != nil {
+		c.Logger().Errorf("failed releasing idempotency key: %v", err)
+	}
+}
+
+func replayResponse(c buffalo.Context, record *models.IdempotencyKey) error {
+	res := c.Response()
+	if record.ContentType.String != "" {
+		res.Header().Set("Content-Type", record.ContentType.String)
+	}
+	res.Header().Set("Idempotent-Replayed", "true")
+	res.WriteHeader(record.Status)
+	_, err := io.WriteString(res, record.Body.String)
+	return err
+}
@@ -0,0 +1,180 @@
+package actions
+
+import (
+	"coke/models"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/httptest"
+	"github.com/gobuffalo/nulls"
+)
+
+func (as *ActionSuite) postWithKey(token, key, path string, body interface{}) *httptest.JSONResponse {
+	req := as.JSON(path)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	if key != "" {
+		req.Headers["Idempotency-Key"] = key
+	}
+	return req.Post(body)
+}
+
+func (as *ActionSuite) Test_Idempotency_Replays_Response() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	user := userJson{
+		Name:                 "user",
+		Email:                "user@mail.com",
+		Password:             "password",
+		PasswordConfirmation: "password",
+		AccessLevel:          nulls.NewInt(1),
+	}
+	first := as.postWithKey(token, "create-user-1", "/users", user)
+	as.Equal(http.StatusCreated, first.Result().StatusCode)
+	as.Empty(first.Header().Get("Idempotent-Replayed"))
+
+	retry := as.postWithKey(token, "create-user-1", "/users", user)
+	as.Equal(http.StatusCreated, retry.Result().StatusCode)
+	as.Equal("true", retry.Header().Get("Idempotent-Replayed"))
+	as.Equal(first.Body.String(), retry.Body.String())
+	as.Contains(retry.Header().Get("Content-Type"), "application/json")
+
+	count, err := as.DB.Where("email = ?", "user@mail.com").Count(&models.User{})
+	as.NoError(err)
+	as.Equal(1, count)
+
+	user.Name = "someone else"
+	res := as.postWithKey(token, "create-user-1", "/users", user)
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+	as.Contains(res.Body.String(), "different request")
+
+	// Without a key the retry runs again.
+	user.Name = "user"
+	res = as.postWithKey(token, "", "/users", user)
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+	as.Contains(res.Body.String(), "email")
+
+	// Keys belong to the user that sent them.
+	_, otherToken := as.newUserWithLevel("other@mail.com", 4)
+	user.Email = "user2@mail.com"
+	res = as.postWithKey(otherToken, "create-user-1", "/users", user)
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+	as.Empty(res.Header().Get("Idempotent-Replayed"))
+}
+
+func (as *ActionSuite) Test_Idempotency_Bulk_And_Expiry() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	body := map[string]interface{}{
+		"create": []map[string]interface{}{newBulkUser("bulk")},
+	}
+	first := as.postWithKey(token, "bulk-1", "/users/bulk", body)
+	as.Equal(http.StatusOK, first.Result().StatusCode)
+
+	retry := as.postWithKey(token, "bulk-1", "/users/bulk", body)
+	as.Equal(http.StatusOK, retry.Result().StatusCode)
+	as.Equal(first.Body.String(), retry.Body.String())
+
+	count, err := as.DB.Count(&models.Users{})
+	as.NoError(err)
+	as.Equal(2, count)
+
+	// Once the window has passed the key starts over.
+	err = as.DB.RawQuery("UPDATE idempotency_keys SET expires_at = ?", time.Now().Add(-time.Minute)).Exec()
+	as.NoError(err)
+	res := as.postWithKey(token, "bulk-1", "/users/bulk", body)
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+	as.Empty(res.Header().Get("Idempotent-Replayed"))
+
+	// Client errors are not kept.
+	count, err = as.DB.Count(&models.IdempotencyKeys{})
+	as.NoError(err)
+	as.Equal(0, count)
+}
+
+func (as *ActionSuite) Test_Idempotency_Client_Errors_Are_Not_Replayed() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	user := userJson{
+		Name:                 "user",
+		Email:                "user@mail.com",
+		Password:             "password",
+		PasswordConfirmation: "other",
+		AccessLevel:          nulls.NewInt(1),
+	}
+	res := as.postWithKey(token, "create-user-1", "/users", user)
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	// The corrected request may reuse the key.
+	user.PasswordConfirmation = "password"
+	res = as.postWithKey(token, "create-user-1", "/users", user)
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+	as.Empty(res.Header().Get("Idempotent-Replayed"))
+
+	res = as.postWithKey(token, "create-user-1", "/users", user)
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+	as.Equal("true", res.Header().Get("Idempotent-Replayed"))
+}
+
+func (as *ActionSuite) Test_Idempotency_Anonymous_Refused() {
+	as.NoError(NewAdmin(as))
+
+	req := as.JSON("/auth")
+	req.Headers["Idempotency-Key"] = "login-1"
+	res := req.Post(&credential{Email: UserAdmin.Email, Password: "password"})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+	as.Contains(res.Body.String(), "signed in")
+
+	res = as.JSON("/auth").Post(&credential{Email: UserAdmin.Email, Password: "password"})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Idempotency_Lease() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	rename := func() *httptest.JSONResponse {
+		req := as.JSON("/me")
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		req.Headers["Idempotency-Key"] = "rename-1"
+		return req.Patch(map[string]string{"name": "renamed"})
+	}
+	as.Equal(http.StatusOK, rename().Result().StatusCode)
+
+	// The first request still holds its lease.
+	err = as.DB.RawQuery("UPDATE idempotency_keys SET status = 0, locked_until = ?", time.Now().Add(time.Minute)).Exec()
+	as.NoError(err)
+	as.Equal(http.StatusConflict, rename().Result().StatusCode)
+
+	// Its lease ran out without an answer, so the retry runs for real.
+	err = as.DB.RawQuery("UPDATE idempotency_keys SET locked_until = ?", time.Now().Add(-time.Minute)).Exec()
+	as.NoError(err)
+	res := rename()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	as.Empty(res.Header().Get("Idempotent-Replayed"))
+
+	res = rename()
+	as.Equal("true", res.Header().Get("Idempotent-Replayed"))
+}
+
+func (as *ActionSuite) Test_Idempotency_Panic_Releases_Key() {
+	token, err := Login(as)
+	as.NoError(err)
+	as.App.POST("/test/panic", func(c buffalo.Context) error {
+		panic("boom")
+	})
+
+	req := as.JSON("/test/panic")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	req.Headers["Idempotency-Key"] = "panic-1"
+	res := req.Post(nil)
+	as.Equal(http.StatusInternalServerError, res.Result().StatusCode)
+
+	count, err := as.DB.Count(&models.IdempotencyKeys{})
+	as.NoError(err)
+	as.Equal(0, count)
+}
@@ -0,0 +1,334 @@
+package actions
+
+import (
+	"coke/internal/policy"
+	"coke/internal/token"
+	"coke/mailers"
+	"coke/models"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+)
+
+var (
+	// InvitationLifetime is how long an invite link stays valid.
+	InvitationLifetime = 7 * 24 * time.Hour
+	// InvitationDefaultRole is used when an invitation names no role.
+	InvitationDefaultRole = "member"
+)
+
+var (
+	errNoOrganization    = errors.New("you are not a member of any organization")
+	errInvitationInvalid = errors.New("invitation invalid")
+	errAlreadyMember     = errors.New("this person is already a member of the organization")
+)
+
+type InvitationResource struct{}
+
+type invitationJson struct {
+	Email string `json:"email"`
+	Role  string `json:"role"`
+}
+
+type invitationAccept struct {
+	Name                 string `json:"name"`
+	Password             string `json:"password"`
+	PasswordConfirmation string `json:"password_confirmation"`
+}
+
+// Index lists the pending invitations of the current organization.
+func (i InvitationResource) Index(c buffalo.Context) error {
+	org := currentOrganization(c)
+	if org == nil {
+		return c.Error(http.StatusForbidden, errNoOrganization)
+	}
+
+	invitations := &models.Invitations{}
+	err := models.DB.Scope(models.PendingInvitation).
+		Where("organization_id = ?", org.ID).Order("created_at desc").All(invitations)
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   invitations,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// Store invites an email address to the current organization. Earlier
+// pending invitations for the same address are revoked.
+func (i InvitationResource) Store(c buffalo.Context) error {
+	org := currentOrganization(c)
+	if org == nil {
+		return c.Error(http.StatusForbidden, errNoOrganization)
+	}
+
+	req := &invitationJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Role == "" {
+		req.Role = InvitationDefaultRole
+	}
+
+	role := &models.Role{}
+	err := models.DB.Where("name = ?", req.Role).First(role)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return err
+	}
+
+	verr := validate.Validate(
+		&validators.EmailIsPresent{Field: req.Email, Name: "email"},
+		&validators.IntIsPresent{Field: role.ID, Name: "role", Message: "Role does not exist."},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	if err := authorize(c, policy.CreateUser, &models.User{AccessLevel: role.Level}); err != nil {
+		return forbidden(c, err)
+	}
+
+	member, err := models.DB.Scope(models.MemberOf(org.ID)).Where("email = ?", req.Email).Exists(&models.User{})
+	if err != nil {
+		return err
+	}
+	if member {
+		return c.Error(http.StatusConflict, errAlreadyMember)
+	}
+
+	auth := c.Value("auth").(*models.User)
+	invitation := &models.Invitation{
+		OrganizationID: org.ID,
+		Email:          req.Email,
+		RoleID:         role.ID,
+		InvitedBy:      nulls.NewInt(auth.ID),
+	}
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		err := tx.RawQuery(
+			"UPDATE invitations SET revoked_at = ? WHERE organization_id = ? AND email = ? AND accepted_at IS NULL AND revoked_at IS NULL",
+			time.Now(), org.ID, req.Email,
+		).Exec()
+		if err != nil {
+			return err
+		}
+
+		return sendInvitation(tx, invitation, org, auth)
+	})
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   invitation,
+		Status: "ok",
+	}
+	return c.Render(http.StatusCreated, r.JSON(response))
+}
+
+// Resend mails a pending invitation again with a fresh token and expiry.
+// The previous link stops working.
+func (i InvitationResource) Resend(c buffalo.Context) error {
+	invitation, err := findPendingInvitation(c)
+	if err != nil {
+		return err
+	}
+
+	org := currentOrganization(c)
+	auth := c.Value("auth").(*models.User)
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		return sendInvitation(tx, invitation, org, auth)
+	})
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   invitation,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// Delete revokes a pending invitation.
+func (i InvitationResource) Delete(c buffalo.Context) error {
+	invitation, err := findPendingInvitation(c)
+	if err != nil {
+		return err
+	}
+
+	invitation.RevokedAt = nulls.NewTime(time.Now())
+	err = models.DB.UpdateColumns(invitation, "revoked_at")
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusNoContent, nil)
+}
+
+// InvitationAccept joins the invited organization. An account is created
+// for addresses that do not have one yet; receiving the email proves the
+// address, so it starts out verified.
+func InvitationAccept(c buffalo.Context) error {
+	req := &invitationAccept{}
+	if c.Request().ContentLength != 0 {
+		if err := c.Bind(req); err != nil {
+			return err
+		}
+	}
+
+	invitation := &models.Invitation{}
+	err := models.DB.Scope(models.PendingInvitation).
+		Where("token_hash = ?", token.Hash(c.Param("token"))).First(invitation)
+	if errors.Is(err, sql.ErrNoRows) {
+		return renderInvitationInvalid(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	role := &models.Role{}
+	err = models.DB.Find(role, invitation.RoleID)
+	if err != nil {
+		return err
+	}
+
+	user := &models.User{}
+	err = models.DB.Where("email = ?", invitation.Email).First(user)
+	newUser := errors.Is(err, sql.ErrNoRows)
+	if err != nil && !newUser {
+		return err
+	}
+	if user.DeletedAt.Valid {
+		return renderInvitationInvalid(c)
+	}
+
+	if newUser {
+		verr := validate.Validate(
+			&validators.StringIsPresent{Field: req.Name, Name: "name"},
+			&validators.StringLengthInRange{Name: "name", Field: req.Name, Min: 3, Max: 100},
+			&validators.StringIsPresent{Field: req.Password, Name: "password"},
+			&validators.StringsMatch{Field: req.Password, Field2: req.PasswordConfirmation, Name: "password", Message: "Password and confirmation did not match."},
+		)
+		if verr.HasAny() {
+			response := Response{
+				Errors: verr.Errors,
+				Status: "error",
+			}
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+		}
+
+		user = &models.User{
+			Name:        req.Name,
+			Email:       invitation.Email,
+			Password:    req.Password,
+			AccessLevel: role.Level,
+			VerifiedAt:  nulls.NewTime(time.Now()),
+		}
+	}
+
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		n, err := tx.RawQuery(
+			"UPDATE invitations SET accepted_at = ? WHERE id = ? AND accepted_at IS NULL AND revoked_at IS NULL",
+			time.Now(), invitation.ID,
+		).ExecWithCount()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errInvitationInvalid
+		}
+
+		if newUser {
+			if err := tx.Create(user); err != nil {
+				return err
+			}
+		}
+
+		member, err := tx.Where("organization_id = ? AND user_id = ?", invitation.OrganizationID, user.ID).Exists(&models.Membership{})
+		if err != nil || member {
+			return err
+		}
+
+		return tx.Create(&models.Membership{
+			OrganizationID: invitation.OrganizationID,
+			UserID:         user.ID,
+			RoleID:         role.ID,
+		})
+	})
+	if errors.Is(err, errInvitationInvalid) {
+		return renderInvitationInvalid(c)
+	}
+	if err != nil {
+		return err
+	}
+
+	status := http.StatusOK
+	if newUser {
+		status = http.StatusCreated
+	}
+	response := Response{
+		Data:   user,
+		Status: "ok",
+	}
+	return c.Render(status, r.JSON(response))
+}
+
+// sendInvitation stores the invitation with a new token and mails it.
+func sendInvitation(tx *pop.Connection, invitation *models.Invitation, org *models.Organization, inviter *models.User) error {
+	inviteToken, err := token.Generate(32)
+	if err != nil {
+		return err
+	}
+
+	invitation.TokenHash = token.Hash(inviteToken)
+	invitation.ExpiresAt = time.Now().Add(InvitationLifetime)
+	if invitation.ID == 0 {
+		err = tx.Create(invitation)
+	} else {
+		err = tx.UpdateColumns(invitation, "token_hash", "expires_at", "updated_at")
+	}
+	if err != nil {
+		return err
+	}
+
+	return mailers.SendInvitation(invitation.Email, org.Name, inviter.Name, inviteToken, InvitationLifetime.String())
+}
+
+func findPendingInvitation(c buffalo.Context) (*models.Invitation, error) {
+	org := currentOrganization(c)
+	if org == nil {
+		return nil, c.Error(http.StatusForbidden, errNoOrganization)
+	}
+
+	invitation := &models.Invitation{}
+	err := models.DB.Scope(models.PendingInvitation).
+		Where("organization_id = ?", org.ID).Find(invitation, c.Param("invitation_id"))
+	if err != nil {
+		return nil, c.Error(http.StatusNotFound, errors.New("invitation not found"))
+	}
+
+	return invitation, nil
+}
+
+func renderInvitationInvalid(c buffalo.Context) error {
+	return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+		Errors: map[string][]string{"token": {"Invitation is invalid, expired or already used"}},
+		Status: "error",
+	}))
+}
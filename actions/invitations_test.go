@@ -0,0 +1,141 @@
+package actions
+
+import (
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// invite sends an invitation as token and returns it along with the token
+// from the emailed link.
+func (as *ActionSuite) invite(token string, email, role string) (models.Invitation, string) {
+	req := as.JSON("/invitations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(&invitationJson{Email: email, Role: role})
+	as.Equal(http.StatusCreated, res.Result().StatusCode, res.Body.String())
+
+	var body struct {
+		Data models.Invitation `json:"data"`
+	}
+	as.NoError(json.Unmarshal(res.Body.Bytes(), &body))
+
+	return body.Data, as.lastInviteToken()
+}
+
+func (as *ActionSuite) lastInviteToken() string {
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.NotEmpty(messages)
+
+	match := linkTokenPattern.FindStringSubmatch(messages[len(messages)-1].Bodies[0].Content)
+	if match == nil {
+		as.FailNow("invitation link not found in email")
+	}
+
+	return match[1]
+}
+
+func (as *ActionSuite) Test_Invitations_Accept_New_User() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	invitation, inviteToken := as.invite(token, "New@Mail.com", "editor")
+	as.Equal("new@mail.com", invitation.Email)
+
+	res := as.JSON("/invitations/%s/accept", inviteToken).Post(&invitationAccept{Name: "new"})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	res = as.JSON("/invitations/%s/accept", inviteToken).Post(&invitationAccept{
+		Name:                 "new user",
+		Password:             "password",
+		PasswordConfirmation: "password",
+	})
+	as.Equal(http.StatusCreated, res.Result().StatusCode, res.Body.String())
+
+	user := &models.User{}
+	as.NoError(as.DB.Where("email = ?", "new@mail.com").First(user))
+	as.True(user.VerifiedAt.Valid)
+	as.NoError(user.LoadPermissions(as.DB, Organization))
+	as.True(user.HasPermission("users:update"))
+	as.False(user.HasPermission("users:delete"))
+
+	res = as.JSON("/invitations/%s/accept", inviteToken).Post(&invitationAccept{})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Invitations_Accept_Existing_User() {
+	token, err := Login(as)
+	as.NoError(err)
+	_, otherAdmin := as.newOtherOrganization()
+
+	_, inviteToken := as.invite(token, otherAdmin.Email, "")
+
+	res := as.JSON("/invitations/%s/accept", inviteToken).Post(nil)
+	as.Equal(http.StatusOK, res.Result().StatusCode, res.Body.String())
+
+	count, err := as.DB.Where("user_id = ?", otherAdmin.ID).Count(&models.Membership{})
+	as.NoError(err)
+	as.Equal(2, count)
+
+	req := as.JSON("/invitations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Post(&invitationJson{Email: otherAdmin.Email})
+	as.Equal(http.StatusConflict, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Invitations_Resend_And_Revoke() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	invitation, first := as.invite(token, "new@mail.com", "")
+
+	req := as.JSON("/invitations/%d/resend", invitation.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(nil)
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	second := as.lastInviteToken()
+	as.NotEqual(first, second)
+
+	res = as.JSON("/invitations/%s/accept", first).Post(nil)
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	req = as.JSON("/invitations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	as.Contains(res.Body.String(), "new@mail.com")
+
+	req = as.JSON("/invitations/%d", invitation.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Delete()
+	as.Equal(http.StatusNoContent, res.Result().StatusCode)
+
+	res = as.JSON("/invitations/%s/accept", second).Post(&invitationAccept{
+		Name:                 "new user",
+		Password:             "password",
+		PasswordConfirmation: "password",
+	})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	req = as.JSON("/invitations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Get()
+	as.NotContains(res.Body.String(), "new@mail.com")
+}
+
+func (as *ActionSuite) Test_Invitations_Role_Ceiling() {
+	as.NoError(NewAdmin(as))
+	_, editor := as.newUserWithLevel("editor@mail.com", 3)
+
+	req := as.JSON("/invitations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", editor)
+	res := req.Post(&invitationJson{Email: "new@mail.com", Role: "admin"})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+
+	_, viewer := as.newUserWithLevel("viewer@mail.com", 2)
+	req = as.JSON("/invitations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", viewer)
+	res = req.Post(&invitationJson{Email: "new@mail.com"})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
@@ -0,0 +1,14 @@
+package actions
+
+import (
+	"net/http"
+
+	"github.com/gobuffalo/buffalo"
+)
+
+// JWKSIndex publishes the public keys that access tokens may be signed
+// with, so other services can verify them without holding a secret.
+func JWKSIndex(c buffalo.Context) error {
+	c.Response().Header().Set("Cache-Control", "public, max-age=300")
+	return c.Render(http.StatusOK, r.JSON(Keys.JWKS()))
+}
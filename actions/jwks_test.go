@@ -0,0 +1,59 @@
+package actions
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"coke/internal/keys"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func (as *ActionSuite) Test_JWKS_Index() {
+	res := as.JSON("/.well-known/jwks.json").Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var set keys.JWKS
+	err := json.Unmarshal(res.Body.Bytes(), &set)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+
+	as.Len(set.Keys, 1)
+	as.Equal(Keys.Signer().ID, set.Keys[0].Kid)
+}
+
+func (as *ActionSuite) Test_AuthJwt_Rejects_Untrusted_Keys() {
+	err := NewAdmin(as)
+	if err != nil {
+		as.T().Fatal("failed creating new User Admin")
+	}
+
+	claims := jwt.MapClaims{
+		"user_id": UserAdmin.ID,
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	}
+
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+	if err != nil {
+		as.FailNow("signing failed", err)
+	}
+
+	other, err := keys.Ephemeral()
+	if err != nil {
+		as.FailNow("failed generating key", err)
+	}
+	foreign, err := other.Sign(claims)
+	if err != nil {
+		as.FailNow("signing failed", err)
+	}
+
+	for _, token := range []string{hmac, foreign} {
+		req := as.JSON("/auth")
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := req.Get()
+		as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+	}
+}
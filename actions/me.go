@@ -0,0 +1,192 @@
+package actions
+
+import (
+	"coke/internal/policy"
+	"coke/models"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	jsonpatch "github.com/evanphx/json-patch/v5"
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate"
+	"github.com/gobuffalo/validate/validators"
+)
+
+// MaxPreferencesSize caps the serialized size of a user's preferences.
+var MaxPreferencesSize = 4096
+
+// meResponse is the current user as they see themselves, preferences
+// included.
+type meResponse struct {
+	models.User
+	Preferences models.Preferences `json:"preferences"`
+}
+
+func newMeResponse(user *models.User) meResponse {
+	preferences := user.Preferences
+	if preferences == nil {
+		preferences = models.Preferences{}
+	}
+
+	return meResponse{User: *user, Preferences: preferences}
+}
+
+type meJson struct {
+	Name        *string         `json:"name"`
+	Email       *string         `json:"email"`
+	Preferences json.RawMessage `json:"preferences"`
+}
+
+type mePasswordJson struct {
+	CurrentPassword      string `json:"current_password"`
+	Password             string `json:"password"`
+	PasswordConfirmation string `json:"password_confirmation"`
+}
+
+// MeShow returns the current user.
+func MeShow(c buffalo.Context) error {
+	auth := c.Value("auth").(*models.User)
+	if err := authorize(c, policy.ReadUser, auth); err != nil {
+		return forbidden(c, err)
+	}
+
+	response := Response{
+		Data:   newMeResponse(auth),
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// MeUpdate changes the current user's name, email or preferences. Fields
+// left out of the body keep their value; preferences are merged as a JSON
+// Merge Patch, so a null removes a key.
+func MeUpdate(c buffalo.Context) error {
+	auth := c.Value("auth").(*models.User)
+	if err := authorize(c, policy.UpdateUser, auth); err != nil {
+		return forbidden(c, err)
+	}
+
+	req := &meJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	name, email := auth.Name, auth.Email
+	if req.Name != nil {
+		name = *req.Name
+	}
+	// Sending the pending address again must not restart its verification.
+	if req.Email != nil && (!auth.PendingEmail.Valid || *req.Email != auth.PendingEmail.String) {
+		email = *req.Email
+	}
+
+	var preferences models.Preferences
+	if len(req.Preferences) > 0 {
+		current, err := json.Marshal(newMeResponse(auth).Preferences)
+		if err != nil {
+			return err
+		}
+
+		merged, err := jsonpatch.MergePatch(current, req.Preferences)
+		if err == nil {
+			err = json.Unmarshal(merged, &preferences)
+		}
+		if err != nil || preferences == nil {
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+				Errors: map[string][]string{"preferences": {"Preferences must be a JSON object"}},
+				Status: "error",
+			}))
+		}
+		if len(merged) > MaxPreferencesSize {
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+				Errors: map[string][]string{"preferences": {"Preferences are too large"}},
+				Status: "error",
+			}))
+		}
+	}
+
+	var newEmail bool
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		var err error
+		newEmail, err = changeUser(tx, auth, name, email)
+		if err != nil || preferences == nil {
+			return err
+		}
+
+		auth.Preferences = preferences
+		return tx.UpdateColumns(auth, "preferences")
+	})
+	var uerr *userError
+	if errors.As(err, &uerr) {
+		return renderUserError(c, uerr)
+	}
+	if err != nil {
+		return err
+	}
+
+	if newEmail {
+		err := requestEmailVerification(auth, email)
+		if err != nil {
+			c.Logger().Errorf("failed sending verification email: %v", err)
+		}
+	}
+
+	response := Response{
+		Data:   newMeResponse(auth),
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// MePassword changes the current user's password. Every other session is
+// signed out, and the caller gets a new token pair in exchange.
+func MePassword(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	req := &mePasswordJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	auth := c.Value("auth").(*models.User)
+	verr := validate.Validate(
+		&validators.StringIsPresent{Field: req.CurrentPassword, Name: "current_password"},
+		&validators.StringIsPresent{Field: req.Password, Name: "password"},
+		&validators.StringsMatch{Field: req.Password, Field2: req.PasswordConfirmation, Name: "password", Message: "Password and confirmation did not match."},
+	)
+	if req.CurrentPassword != "" {
+		ok, err := verifyPassword(c, auth, req.CurrentPassword)
+		if errors.Is(err, errTooManyAttempts) {
+			return tooManyAttempts(c)
+		}
+		if !ok {
+			verr.Add("current_password", "Current password is incorrect.")
+		}
+	}
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		if err := auth.ChangePassword(tx, req.Password); err != nil {
+			return err
+		}
+		if err := models.RevokeUserRefreshTokens(tx, auth.ID); err != nil {
+			return err
+		}
+		return auth.RevokeTokens(tx)
+	})
+	if err != nil {
+		return err
+	}
+
+	return startSession(c, auth)
+}
@@ -0,0 +1,145 @@
+package actions
+
+import (
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/httptest"
+)
+
+func (as *ActionSuite) Test_Me_Show_Update() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	me := func(method string, body interface{}) (int, map[string]interface{}) {
+		req := as.JSON("/me")
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		var res *httptest.JSONResponse
+		if method == http.MethodPatch {
+			res = req.Patch(body)
+		} else {
+			res = req.Get()
+		}
+
+		response := struct {
+			Data   map[string]interface{} `json:"data"`
+			Errors interface{}            `json:"errors"`
+		}{}
+		as.NoError(json.Unmarshal(res.Body.Bytes(), &response))
+		if response.Data == nil {
+			response.Data = map[string]interface{}{"errors": response.Errors}
+		}
+		return res.Result().StatusCode, response.Data
+	}
+
+	code, data := me(http.MethodGet, nil)
+	as.Equal(http.StatusOK, code)
+	as.Equal(UserAdmin.Email, data["email"])
+	as.Equal(map[string]interface{}{}, data["preferences"])
+	as.NotContains(data, "password")
+
+	code, data = me(http.MethodPatch, map[string]interface{}{
+		"name":        "renamed",
+		"preferences": map[string]interface{}{"theme": "dark", "locale": "id"},
+	})
+	as.Equal(http.StatusOK, code)
+	as.Equal("renamed", data["name"])
+	as.Equal(UserAdmin.Email, data["email"])
+
+	code, data = me(http.MethodPatch, map[string]interface{}{
+		"email":       "new@mail.com",
+		"preferences": map[string]interface{}{"locale": nil},
+	})
+	as.Equal(http.StatusOK, code)
+	as.Equal("renamed", data["name"])
+	as.Equal("new@mail.com", data["pending_email"])
+	as.Equal(map[string]interface{}{"theme": "dark"}, data["preferences"])
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 1)
+
+	// Sending the pending address again does not send another email.
+	code, _ = me(http.MethodPatch, map[string]interface{}{"email": "new@mail.com"})
+	as.Equal(http.StatusOK, code)
+	messages, err = Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 1)
+
+	code, data = me(http.MethodPatch, map[string]interface{}{"name": "x", "preferences": []int{1}})
+	as.Equal(http.StatusUnprocessableEntity, code)
+	as.Contains(data["errors"], "preferences")
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, UserAdmin.ID))
+	as.Equal("renamed", user.Name)
+	as.Equal(models.Preferences{"theme": "dark"}, user.Preferences)
+}
+
+func (as *ActionSuite) Test_Me_Password() {
+	as.NoError(NewAdmin(as))
+	tokens := as.authenticate()
+	other := as.authenticate()
+
+	change := func(bearer string, body map[string]string) (int, tokenPair) {
+		req := as.JSON("/me/password")
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", bearer)
+		res := req.Post(body)
+
+		pair := tokenPair{}
+		json.Unmarshal(res.Body.Bytes(), &pair)
+		return res.Result().StatusCode, pair
+	}
+
+	code, _ := change(tokens.Token, map[string]string{"current_password": "wrong", "password": "secret", "password_confirmation": "secret"})
+	as.Equal(http.StatusUnprocessableEntity, code)
+	code, _ = change(tokens.Token, map[string]string{"current_password": "password", "password": "secret", "password_confirmation": "other"})
+	as.Equal(http.StatusUnprocessableEntity, code)
+
+	// Tokens issued earlier in the same second as the change stay valid.
+	time.Sleep(time.Second)
+	code, fresh := change(tokens.Token, map[string]string{"current_password": "password", "password": "secret", "password_confirmation": "secret"})
+	as.Equal(http.StatusOK, code)
+	as.NotEmpty(fresh.Token)
+
+	get := func(bearer string) int {
+		req := as.JSON("/me")
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", bearer)
+		return req.Get().Result().StatusCode
+	}
+	as.Equal(http.StatusUnauthorized, get(tokens.Token))
+	as.Equal(http.StatusUnauthorized, get(other.Token))
+	as.Equal(http.StatusOK, get(fresh.Token))
+
+	res := as.JSON("/auth/refresh").Post(&refreshRequest{RefreshToken: other.RefreshToken})
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+
+	res = as.JSON("/auth").Post(&credential{Email: UserAdmin.Email, Password: "secret"})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Me_Password_Attempts() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	change := func(current string) int {
+		req := as.JSON("/me/password")
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		body := map[string]string{"current_password": current, "password": "secret", "password_confirmation": "secret"}
+		return req.Post(body).Result().StatusCode
+	}
+
+	for i := 0; i < MaxAttempts; i++ {
+		as.Equal(http.StatusUnprocessableEntity, change("wrong"))
+	}
+	as.Equal(http.StatusTooManyRequests, change("password"))
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, UserAdmin.ID))
+	as.Equal(models.StatusLocked, user.Status)
+}
@@ -0,0 +1,235 @@
+package actions
+
+import (
+	"coke/internal/cache"
+	"coke/internal/identity"
+	"coke/internal/token"
+	"coke/models"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+)
+
+// IdentityProviders are the external providers users may sign in with,
+// keyed by the name used in /auth/oidc/{provider}/... routes. They are
+// read from IDENTITY_PROVIDERS_FILE when the app starts.
+var IdentityProviders = map[string]identity.Authenticator{}
+
+// OIDCLoginLifetime is how long a user has to finish signing in at the
+// provider before the callback is refused.
+var OIDCLoginLifetime = 10 * time.Minute
+
+// oidcStateCookie holds the hash of the state of the login in progress.
+const oidcStateCookie = "oidc_state"
+
+var (
+	errIdentityNotLinked    = errors.New("no account is linked to this identity")
+	errIdentityEmailInvalid = errors.New("identity provider sent an invalid email address")
+)
+
+type oidcLogin struct {
+	Provider string
+	Login    identity.Login
+}
+
+// OIDCStart sends the user to the provider's login page. The state, nonce
+// and PKCE verifier are remembered until the callback, which only accepts
+// the state from the browser that started the login.
+func OIDCStart(c buffalo.Context) error {
+	provider, ok := IdentityProviders[c.Param("provider")]
+	if !ok {
+		return c.Error(http.StatusNotFound, errors.New("unknown identity provider"))
+	}
+
+	login, err := identity.NewLogin()
+	if err != nil {
+		return err
+	}
+
+	u, err := provider.AuthCodeURL(c.Request().Context(), login)
+	if err != nil {
+		return c.Error(http.StatusBadGateway, err)
+	}
+
+	cache.Cache.Add(getOIDCCacheKey(login.State), OIDCLoginLifetime, oidcLogin{
+		Provider: provider.Name(),
+		Login:    login,
+	})
+	// Ties the state to this browser, so a callback started elsewhere can
+	// not sign it in to someone else's account.
+	http.SetCookie(c.Response(), &http.Cookie{
+		Name:     oidcStateCookie,
+		Value:    token.Hash(login.State),
+		Path:     "/auth/oidc/",
+		MaxAge:   int(OIDCLoginLifetime.Seconds()),
+		Secure:   ENV == "production",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	return c.Redirect(http.StatusFound, u)
+}
+
+// OIDCCallback completes a login started by OIDCStart. The user is found
+// through an existing identity link or their verified email, provisioned
+// if the provider allows it, and then signed in like AuthCreate would.
+func OIDCCallback(c buffalo.Context) error {
+	provider, ok := IdentityProviders[c.Param("provider")]
+	if !ok {
+		return c.Error(http.StatusNotFound, errors.New("unknown identity provider"))
+	}
+
+	cookie, err := c.Request().Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(token.Hash(c.Param("state")))) != 1 {
+		return c.Error(http.StatusBadRequest, errors.New("login was not started in this browser"))
+	}
+	http.SetCookie(c.Response(), &http.Cookie{Name: oidcStateCookie, Path: "/auth/oidc/", MaxAge: -1})
+
+	// Deleting the entry makes every state single use.
+	item, err := cache.Cache.Delete(getOIDCCacheKey(c.Param("state")))
+	if err != nil {
+		return c.Error(http.StatusBadRequest, errors.New("login state is invalid or expired"))
+	}
+	login := item.Data().(oidcLogin)
+	if login.Provider != provider.Name() {
+		return c.Error(http.StatusBadRequest, errors.New("login state is invalid or expired"))
+	}
+
+	if e := c.Param("error"); e != "" {
+		return c.Error(http.StatusUnauthorized, fmt.Errorf("identity provider refused login: %s", e))
+	}
+	if c.Param("code") == "" {
+		return c.Error(http.StatusBadRequest, errors.New("authorization code is missing"))
+	}
+
+	id, err := provider.Exchange(c.Request().Context(), c.Param("code"), login.Login)
+	if errors.Is(err, identity.ErrInvalidIdentity) {
+		return c.Error(http.StatusUnauthorized, err)
+	}
+	if err != nil {
+		return c.Error(http.StatusBadGateway, err)
+	}
+
+	user, err := userForIdentity(id, provider.AutoProvision())
+	if errors.Is(err, errIdentityNotLinked) {
+		return c.Error(http.StatusForbidden, err)
+	}
+	if errors.Is(err, errIdentityEmailInvalid) {
+		return c.Error(http.StatusUnauthorized, err)
+	}
+	if err != nil {
+		return err
+	}
+
+	return completeLogin(c, user)
+}
+
+// userForIdentity resolves the local user for an external identity. Email
+// matching only happens when the provider vouches for the address.
+func userForIdentity(id *identity.Identity, provision bool) (*models.User, error) {
+	user := &models.User{}
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		link := &models.UserIdentity{}
+		err := tx.Where("provider = ? AND subject = ?", id.Provider, id.Subject).First(link)
+		if err == nil {
+			err = tx.Find(user, link.UserID)
+			if err == nil && user.DeletedAt.Valid {
+				return errIdentityNotLinked
+			}
+			return err
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		if id.Email == "" || !id.EmailVerified {
+			return errIdentityNotLinked
+		}
+
+		err = tx.Where("email = ?", id.Email).First(user)
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			if !provision {
+				return errIdentityNotLinked
+			}
+			if err := provisionUser(tx, user, id); err != nil {
+				return err
+			}
+		case err != nil:
+			return err
+		case user.DeletedAt.Valid:
+			return errIdentityNotLinked
+		case !user.VerifiedAt.Valid:
+			// The provider has just confirmed the address for us.
+			user.VerifiedAt = nulls.NewTime(time.Now())
+			if err := tx.UpdateColumns(user, "verified_at"); err != nil {
+				return err
+			}
+		}
+
+		return tx.Create(&models.UserIdentity{
+			UserID:   user.ID,
+			Provider: id.Provider,
+			Subject:  id.Subject,
+			Email:    id.Email,
+		})
+	})
+
+	return user, err
+}
+
+// provisionUser creates an account for a first time federated login. The
+// password is random since the user signs in through the provider.
+func provisionUser(tx *pop.Connection, user *models.User, id *identity.Identity) error {
+	password, err := token.Generate(32)
+	if err != nil {
+		return err
+	}
+
+	verr := validate.Validate(&validators.EmailIsPresent{Name: "email", Field: id.Email})
+	if verr.HasAny() {
+		return errIdentityEmailInvalid
+	}
+
+	// Names go through the same rule as Store, with the email as the last
+	// resort.
+	name := id.Name
+	if name == "" {
+		name = id.Email[:strings.Index(id.Email, "@")]
+	}
+	verr = validate.Validate(&validators.StringLengthInRange{Name: "name", Field: name, Min: 3, Max: 100})
+	if verr.HasAny() {
+		name = id.Email
+	}
+
+	*user = models.User{
+		Name:        name,
+		Email:       id.Email,
+		Password:    password,
+		AccessLevel: nulls.NewInt(RegistrationAccessLevel),
+		VerifiedAt:  nulls.NewTime(time.Now()),
+	}
+
+	return tx.Create(user)
+}
+
+// loadIdentityProviders reads the providers file. A missing file simply
+// disables federated login.
+func loadIdentityProviders() (map[string]identity.Authenticator, error) {
+	return identity.Load(envy.Get("IDENTITY_PROVIDERS_FILE", "config/identity_providers.toml"))
+}
+
+func getOIDCCacheKey(state string) string {
+	return fmt.Sprintf("oidc:%s", state)
+}
@@ -0,0 +1,243 @@
+package actions
+
+import (
+	"coke/internal/identity"
+	"coke/internal/keys"
+	"coke/models"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// mockIssuer is a minimal OIDC provider. Tests play the part of the user
+// signing in by reading the authorize redirect and setting the code the
+// token endpoint will accept.
+type mockIssuer struct {
+	*httptest.Server
+	keys *keys.Set
+
+	subject  string
+	email    string
+	name     string
+	verified bool
+	// issuer is sent as iss when set, instead of the server URL.
+	issuer string
+
+	code      string
+	challenge string
+	nonce     string
+}
+
+func (as *ActionSuite) newMockIssuer(provision bool) *mockIssuer {
+	set, err := keys.Ephemeral()
+	as.NoError(err)
+
+	m := &mockIssuer{keys: set, subject: "sub-1", email: "jane@mail.com", name: "Jane", verified: true}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(m.keys.JWKS())
+	})
+	mux.HandleFunc("/token", m.token)
+	m.Server = httptest.NewServer(mux)
+	as.T().Cleanup(m.Close)
+
+	provider, err := identity.NewOIDC(identity.OIDCConfig{
+		Name:          "mock",
+		Issuer:        m.URL,
+		ClientID:      "coke",
+		RedirectURL:   "http://127.0.0.1/auth/oidc/mock/callback",
+		AutoProvision: provision,
+	})
+	as.NoError(err)
+	IdentityProviders = map[string]identity.Authenticator{"mock": provider}
+	as.T().Cleanup(func() { IdentityProviders = map[string]identity.Authenticator{} })
+
+	return m
+}
+
+func (m *mockIssuer) token(w http.ResponseWriter, r *http.Request) {
+	sum := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if r.PostFormValue("code") != m.code || base64.RawURLEncoding.EncodeToString(sum[:]) != m.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+
+	iss := m.URL
+	if m.issuer != "" {
+		iss = m.issuer
+	}
+	now := time.Now()
+	idToken, _ := m.keys.Sign(jwt.MapClaims{
+		"iss":            iss,
+		"aud":            "coke",
+		"sub":            m.subject,
+		"email":          m.email,
+		"email_verified": m.verified,
+		"name":           m.name,
+		"nonce":          m.nonce,
+		"iat":            now.Unix(),
+		"exp":            now.Add(time.Minute).Unix(),
+	})
+	json.NewEncoder(w).Encode(map[string]string{"id_token": idToken, "token_type": "Bearer"})
+}
+
+// oidcLogin runs the whole flow and returns the callback response.
+func (as *ActionSuite) oidcLogin(m *mockIssuer) *httptest.ResponseRecorder {
+	state, cookie := as.oidcStart(m)
+	return as.oidcCallback(m, state, cookie)
+}
+
+// oidcCallback returns to the app from the provider, in a browser holding
+// cookie. The suite's JSON requests can not carry cookies of their own.
+func (as *ActionSuite) oidcCallback(m *mockIssuer, state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/oidc/mock/callback?code="+m.code+"&state="+state, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	rec := httptest.NewRecorder()
+	as.App.ServeHTTP(rec, req)
+	return rec
+}
+
+// oidcStart plays the user's part at the provider and returns the state
+// and the cookie the browser was given.
+func (as *ActionSuite) oidcStart(m *mockIssuer) (string, *http.Cookie) {
+	res := as.JSON("/auth/oidc/mock/start").Get()
+	as.Equal(http.StatusFound, res.Code)
+	cookies := res.Result().Cookies()
+	as.Len(cookies, 1)
+
+	location, err := url.Parse(res.Header().Get("Location"))
+	as.NoError(err)
+	q := location.Query()
+	as.Equal(m.URL+"/authorize", location.Scheme+"://"+location.Host+location.Path)
+	as.Equal("S256", q.Get("code_challenge_method"))
+
+	m.code, m.challenge, m.nonce = "code-"+q.Get("state"), q.Get("code_challenge"), q.Get("nonce")
+
+	return q.Get("state"), cookies[0]
+}
+
+func (as *ActionSuite) Test_OIDC_State_Bound_To_Browser() {
+	m := as.newMockIssuer(true)
+
+	// A victim following the attacker's callback link has no cookie, or
+	// one for their own login.
+	state, _ := as.oidcStart(m)
+	as.Equal(http.StatusBadRequest, as.oidcCallback(m, state, nil).Code)
+
+	_, other := as.oidcStart(m)
+	as.Equal(http.StatusBadRequest, as.oidcCallback(m, state, other).Code)
+
+	count, err := as.DB.Count(&models.User{})
+	as.NoError(err)
+	as.Equal(0, count)
+}
+
+func (as *ActionSuite) Test_OIDC_Issuer_Trailing_Slash() {
+	m := as.newMockIssuer(true)
+	m.issuer = m.URL + "/"
+
+	res := as.oidcLogin(m)
+	as.Equal(http.StatusOK, res.Code, res.Body.String())
+}
+
+func (as *ActionSuite) Test_OIDC_Provision() {
+	m := as.newMockIssuer(true)
+
+	res := as.oidcLogin(m)
+	as.Equal(http.StatusOK, res.Code, res.Body.String())
+	pair := &tokenPair{}
+	as.NoError(json.Unmarshal(res.Body.Bytes(), pair))
+	as.NotEmpty(pair.Token)
+
+	user := &models.User{}
+	as.NoError(as.DB.Where("email = ?", "jane@mail.com").First(user))
+	as.Equal(RegistrationAccessLevel, user.AccessLevel.Int)
+	as.True(user.VerifiedAt.Valid)
+
+	// The identity link is used from now on, even if the email changes.
+	m.email = "jane.doe@mail.com"
+	res = as.oidcLogin(m)
+	as.Equal(http.StatusOK, res.Code, res.Body.String())
+	count, err := as.DB.Count(&models.User{})
+	as.NoError(err)
+	as.Equal(1, count)
+}
+
+func (as *ActionSuite) Test_OIDC_LinkByEmail() {
+	m := as.newMockIssuer(false)
+	as.NoError(NewAdmin(as))
+	m.email = UserAdmin.Email
+
+	m.verified = false
+	res := as.oidcLogin(m)
+	as.Equal(http.StatusForbidden, res.Code)
+
+	m.verified = true
+	res = as.oidcLogin(m)
+	as.Equal(http.StatusOK, res.Code, res.Body.String())
+
+	link := &models.UserIdentity{}
+	as.NoError(as.DB.Where("provider = ? AND subject = ?", "mock", m.subject).First(link))
+	as.Equal(UserAdmin.ID, link.UserID)
+}
+
+func (as *ActionSuite) Test_OIDC_NoProvision() {
+	m := as.newMockIssuer(false)
+
+	res := as.oidcLogin(m)
+	as.Equal(http.StatusForbidden, res.Code)
+}
+
+func (as *ActionSuite) Test_OIDC_Callback_Invalid() {
+	m := as.newMockIssuer(true)
+
+	res := as.JSON("/auth/oidc/unknown/start").Get()
+	as.Equal(http.StatusNotFound, res.Code)
+
+	res = as.JSON("/auth/oidc/mock/callback?code=x&state=forged").Get()
+	as.Equal(http.StatusBadRequest, res.Code)
+
+	// A nonce that does not match the one sent at start is refused.
+	state, cookie := as.oidcStart(m)
+	m.nonce = "replayed"
+	as.Equal(http.StatusUnauthorized, as.oidcCallback(m, state, cookie).Code)
+
+	// States are single use.
+	as.Equal(http.StatusBadRequest, as.oidcCallback(m, state, cookie).Code)
+}
+
+func (as *ActionSuite) Test_OIDC_Provision_Invalid_Claims() {
+	m := as.newMockIssuer(true)
+
+	m.email = "not-an-email"
+	res := as.oidcLogin(m)
+	as.Equal(http.StatusUnauthorized, res.Code, res.Body.String())
+	count, err := as.DB.Count(&models.User{})
+	as.NoError(err)
+	as.Equal(0, count)
+
+	// A name too short for Store falls back to the email.
+	m.email, m.name = "jo@mail.com", ""
+	res = as.oidcLogin(m)
+	as.Equal(http.StatusOK, res.Code, res.Body.String())
+	user := &models.User{}
+	as.NoError(as.DB.Where("email = ?", "jo@mail.com").First(user))
+	as.Equal("jo@mail.com", user.Name)
+}
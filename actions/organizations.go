@@ -0,0 +1,138 @@
+package actions
+
+import (
+	"coke/internal/rules"
+	"coke/models"
+	"errors"
+	"net/http"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate"
+	"github.com/gobuffalo/validate/validators"
+)
+
+type OrganizationResource struct{}
+
+type organizationJson struct {
+	Name string `json:"name"`
+}
+
+// Index lists the organizations the current user belongs to.
+func (o OrganizationResource) Index(c buffalo.Context) error {
+	auth := c.Value("auth").(*models.User)
+
+	orgs := &models.Organizations{}
+	err := models.DB.Where("id IN (SELECT organization_id FROM memberships WHERE user_id = ?)", auth.ID).
+		Order("name asc").All(orgs)
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   orgs,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// Store creates an organization with the current user as a member, in
+// the role for their access level.
+func (o OrganizationResource) Store(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	req := &organizationJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	org := &models.Organization{Name: req.Name, Slug: models.Slugify(req.Name)}
+	verr := validate.Validate(
+		&validators.StringIsPresent{Field: org.Name, Name: "name"},
+		&validators.StringLengthInRange{Name: "name", Field: org.Name, Min: 2, Max: 100},
+		&validators.StringIsPresent{Field: org.Slug, Name: "slug", Message: "Name must contain letters or digits."},
+		&rules.Unique{Name: "slug", Field: org.Slug, Model: &models.Organization{}},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	auth := c.Value("auth").(*models.User)
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		if err := tx.Create(org); err != nil {
+			return err
+		}
+
+		// The creator gets no more power than their own access level.
+		return models.AddMember(tx, org.ID, auth)
+	})
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   org,
+		Status: "ok",
+	}
+	return c.Render(http.StatusCreated, r.JSON(response))
+}
+
+// errSharedAccount refuses account wide changes made from one organization
+// to a user who also belongs to others.
+var errSharedAccount = errors.New("This user also belongs to other organizations")
+
+// accountOwned reports whether account wide changes, such as the access
+// level, may be made to the user from the current organization. That is
+// only the case when the user belongs to no other organization, so one
+// organization's admins can not change what the user may do in another.
+func accountOwned(c buffalo.Context, user *models.User) (bool, error) {
+	org := currentOrganization(c)
+	if org == nil {
+		return true, nil
+	}
+
+	others, err := models.DB.Where("user_id = ? AND organization_id != ?", user.ID, org.ID).Count(&models.Membership{})
+	if err != nil {
+		return false, err
+	}
+
+	return others == 0, nil
+}
+
+// currentOrganization is the organization the request acts in, or nil
+// when the user does not belong to any.
+func currentOrganization(c buffalo.Context) *models.Organization {
+	org, _ := c.Value("organization").(*models.Organization)
+	return org
+}
+
+// scopeUsers limits users queries to the members of the current
+// organization that have not been deleted. Outside of one, users can only
+// reach their own record.
+func scopeUsers(c buffalo.Context) pop.ScopeFunc {
+	scope := scopeAllUsers(c)
+	return func(q *pop.Query) *pop.Query {
+		return models.NotDeleted(scope(q))
+	}
+}
+
+// scopeAllUsers is scopeUsers including soft deleted users.
+func scopeAllUsers(c buffalo.Context) pop.ScopeFunc {
+	if org := currentOrganization(c); org != nil {
+		return models.MemberOf(org.ID)
+	}
+
+	auth, _ := c.Value("auth").(*models.User)
+	return func(q *pop.Query) *pop.Query {
+		if auth == nil {
+			return q.Where("1 = 0")
+		}
+		return q.Where("users.id = ?", auth.ID)
+	}
+}
@@ -0,0 +1,136 @@
+package actions
+
+import (
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gobuffalo/nulls"
+)
+
+// newOtherOrganization creates a second organization with its own admin.
+func (as *ActionSuite) newOtherOrganization() (*models.Organization, *models.User) {
+	org := &models.Organization{Name: "Other", Slug: "other"}
+	as.NoError(as.DB.Create(org))
+
+	user := &models.User{Name: "other", Email: "other@mail.com", Password: "password", AccessLevel: nulls.NewInt(4)}
+	as.NoError(as.DB.Create(user))
+	as.NoError(models.AddMember(as.DB, org.ID, user))
+
+	return org, user
+}
+
+func (as *ActionSuite) Test_Organizations_Scope_Users() {
+	token, err := Login(as)
+	as.NoError(err)
+	other, otherAdmin := as.newOtherOrganization()
+
+	req := as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	var body struct {
+		Data []models.User `json:"data"`
+	}
+	as.NoError(json.Unmarshal(res.Body.Bytes(), &body))
+	as.Len(body.Data, 1)
+	as.Equal(UserAdmin.ID, body.Data[0].ID)
+
+	req = as.JSON("/users/%d", otherAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Get()
+	as.Equal(http.StatusNotFound, res.Result().StatusCode)
+
+	req = as.JSON("/users/%d", otherAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Delete()
+	as.Equal(http.StatusNotFound, res.Result().StatusCode)
+
+	req = as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	req.Headers["X-Organization-ID"] = fmt.Sprint(other.ID)
+	res = req.Get()
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Organizations_Role_Per_Organization() {
+	as.NoError(NewAdmin(as))
+	other, _ := as.newOtherOrganization()
+
+	// A member in the test organization but an admin in the other one.
+	user, token := as.newUserWithLevel("member@mail.com", 1)
+	admin := &models.Role{}
+	as.NoError(as.DB.Where("name = ?", "admin").First(admin))
+	as.NoError(as.DB.Create(&models.Membership{OrganizationID: other.ID, UserID: user.ID, RoleID: admin.ID}))
+
+	req := as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	req.Headers["X-Organization-ID"] = fmt.Sprint(Organization.ID)
+	res := req.Get()
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+
+	req = as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	req.Headers["X-Organization-ID"] = fmt.Sprint(other.ID)
+	res = req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	// Removing them from one organization leaves the account in place.
+	adminToken, err := newAccessToken(UserAdmin)
+	as.NoError(err)
+	req = as.JSON("/users/%d", user.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", adminToken)
+	res = req.Delete()
+	as.Equal(http.StatusNoContent, res.Result().StatusCode)
+
+	count, err := as.DB.Where("id = ?", user.ID).Count(&models.User{})
+	as.NoError(err)
+	as.Equal(1, count)
+	count, err = as.DB.Where("user_id = ?", user.ID).Count(&models.Membership{})
+	as.NoError(err)
+	as.Equal(1, count)
+}
+
+func (as *ActionSuite) Test_Organizations_Create() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	req := as.JSON("/organizations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(&organizationJson{Name: "Acme Corp"})
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+
+	org := &models.Organization{}
+	as.NoError(as.DB.Where("slug = ?", "acme-corp").First(org))
+
+	req = as.JSON("/organizations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Post(&organizationJson{Name: "acme corp"})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	req = as.JSON("/organizations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	as.Contains(res.Body.String(), "acme-corp")
+	as.Contains(res.Body.String(), `"slug":"test"`)
+}
+
+func (as *ActionSuite) Test_Organizations_Create_Role_For_Level() {
+	_, token := as.newUserWithLevel("member@mail.com", 1)
+
+	req := as.JSON("/organizations")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(&organizationJson{Name: "Side Project"})
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+
+	role := &models.Role{}
+	err := as.DB.RawQuery(
+		"SELECT roles.* FROM roles JOIN memberships ON memberships.role_id = roles.id "+
+			"JOIN organizations ON organizations.id = memberships.organization_id WHERE organizations.slug = ?",
+		"side-project",
+	).First(role)
+	as.NoError(err)
+	as.Equal("member", role.Name)
+}
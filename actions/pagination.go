@@ -0,0 +1,120 @@
+package actions
+
+import (
+	"coke/internal/cursor"
+	"coke/models"
+	"crypto/rand"
+	"errors"
+	"log"
+	"strconv"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// CursorSecret signs pagination cursors.
+var CursorSecret []byte
+
+// CursorMaxPerPage caps per_page in cursor mode.
+var CursorMaxPerPage = 100
+
+// cursorMeta is Response.Meta for cursor paginated lists. A nil cursor
+// means there is no page in that direction.
+type cursorMeta struct {
+	PerPage    int     `json:"per_page"`
+	NextCursor *string `json:"next_cursor"`
+	PrevCursor *string `json:"prev_cursor"`
+}
+
+// usesCursor reports whether the client opted into cursor pagination.
+// An empty cursor parameter asks for the first page.
+func usesCursor(c buffalo.Context) bool {
+	_, ok := c.Request().URL.Query()["cursor"]
+	return ok
+}
+
+// paginateUsersByCursor loads one page of q ordered by (created_at, id).
+// The query must not carry an order of its own.
+func paginateUsersByCursor(c buffalo.Context, q *pop.Query, users *models.Users) (*cursorMeta, error) {
+	perPage, err := strconv.Atoi(c.Param("per_page"))
+	if err != nil || perPage < 1 {
+		perPage = pop.PaginatorPerPageDefault
+	}
+	if perPage > CursorMaxPerPage {
+		perPage = CursorMaxPerPage
+	}
+
+	var at *cursor.Cursor
+	if raw := c.Param("cursor"); raw != "" {
+		cur, err := cursor.Decode(CursorSecret, raw)
+		if err != nil {
+			return nil, err
+		}
+		at = &cur
+	}
+
+	backward := at != nil && at.Before
+	switch {
+	case at == nil:
+		q = q.Order("users.created_at asc").Order("users.id asc")
+	case backward:
+		q = q.Where("(users.created_at < ? OR (users.created_at = ? AND users.id < ?))", at.CreatedAt, at.CreatedAt, at.ID).
+			Order("users.created_at desc").Order("users.id desc")
+	default:
+		q = q.Where("(users.created_at > ? OR (users.created_at = ? AND users.id > ?))", at.CreatedAt, at.CreatedAt, at.ID).
+			Order("users.created_at asc").Order("users.id asc")
+	}
+
+	// One extra row tells whether another page follows.
+	err = q.Limit(perPage + 1).All(users)
+	if err != nil {
+		return nil, err
+	}
+	more := len(*users) > perPage
+	if more {
+		*users = (*users)[:perPage]
+	}
+	if backward {
+		for i, j := 0, len(*users)-1; i < j; i, j = i+1, j-1 {
+			(*users)[i], (*users)[j] = (*users)[j], (*users)[i]
+		}
+	}
+
+	meta := &cursorMeta{PerPage: perPage}
+	if len(*users) == 0 {
+		return meta, nil
+	}
+
+	first, last := (*users)[0], (*users)[len(*users)-1]
+	if (backward && more) || (!backward && at != nil) {
+		prev := cursor.Encode(CursorSecret, cursor.Cursor{CreatedAt: first.CreatedAt, ID: first.ID, Before: true})
+		meta.PrevCursor = &prev
+	}
+	if backward || more {
+		next := cursor.Encode(CursorSecret, cursor.Cursor{CreatedAt: last.CreatedAt, ID: last.ID})
+		meta.NextCursor = &next
+	}
+
+	return meta, nil
+}
+
+// loadCursorSecret reads the key for pagination cursors from
+// CURSOR_SECRET. It must be the same on every replica and across restarts
+// or clients lose their place, so only outside production does a missing
+// key fall back to a throwaway one.
+func loadCursorSecret() ([]byte, error) {
+	if secret := envy.Get("CURSOR_SECRET", ""); secret != "" {
+		return []byte(secret), nil
+	}
+	if ENV == "production" {
+		return nil, errors.New("CURSOR_SECRET must be set in production")
+	}
+
+	log.Printf("CURSOR_SECRET not set, signing cursors with an ephemeral key")
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
@@ -0,0 +1,186 @@
+package actions
+
+import (
+	"coke/internal/cache"
+	"coke/internal/token"
+	"coke/mailers"
+	"coke/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+)
+
+var (
+	// PasswordResetLifetime is how long a reset link stays valid.
+	PasswordResetLifetime = time.Hour
+	// PasswordResetCooldown limits how often a reset email can be sent to
+	// the same address.
+	PasswordResetCooldown = time.Minute
+)
+
+var errResetTokenInvalid = errors.New("reset token invalid")
+
+type passwordForgot struct {
+	Email string `json:"email"`
+}
+
+type passwordReset struct {
+	Token                string `json:"token"`
+	Password             string `json:"password"`
+	PasswordConfirmation string `json:"password_confirmation"`
+}
+
+// PasswordForgot emails a reset link when the address belongs to a user.
+// The response is the same either way so that it can not be used to find
+// out which addresses have accounts.
+func PasswordForgot(c buffalo.Context) error {
+	req := &passwordForgot{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	verr := validate.Validate(
+		&validators.EmailIsPresent{Name: "email", Field: req.Email},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	response := Response{
+		Data:   "If the address belongs to an account, a reset link has been sent",
+		Status: "ok",
+	}
+
+	cooldownKey := fmt.Sprintf("password_reset:%s", req.Email)
+	if cache.Cache.Exists(cooldownKey) {
+		return c.Render(http.StatusAccepted, r.JSON(response))
+	}
+
+	user := &models.User{}
+	err := models.DB.Scope(models.NotDeleted).Where("email = (?)", req.Email).First(user)
+	if err != nil {
+		return c.Render(http.StatusAccepted, r.JSON(response))
+	}
+
+	resetToken, err := token.Generate(32)
+	if err != nil {
+		return err
+	}
+
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		// Only the most recent link is usable.
+		err := tx.RawQuery(
+			"UPDATE password_resets SET used_at = ? WHERE user_id = ? AND used_at IS NULL",
+			time.Now(), user.ID,
+		).Exec()
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&models.PasswordReset{
+			UserID:    user.ID,
+			TokenHash: token.Hash(resetToken),
+			ExpiresAt: time.Now().Add(PasswordResetLifetime),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	err = mailers.SendPasswordReset(user, resetToken, PasswordResetLifetime.String())
+	if err != nil {
+		// Failing here only for existing accounts would give them away.
+		c.Logger().Errorf("failed sending password reset: %v", err)
+		return c.Render(http.StatusAccepted, r.JSON(response))
+	}
+
+	cache.Cache.Add(cooldownKey, PasswordResetCooldown, true)
+
+	return c.Render(http.StatusAccepted, r.JSON(response))
+}
+
+// PasswordReset sets a new password using a token from PasswordForgot. The
+// token is consumed, and every token issued to the user is revoked.
+func PasswordReset(c buffalo.Context) error {
+	req := &passwordReset{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	verr := validate.Validate(
+		&validators.StringIsPresent{Name: "token", Field: req.Token},
+		&validators.StringIsPresent{Name: "password", Field: req.Password},
+		&validators.StringsMatch{Name: "password", Field: req.Password, Field2: req.PasswordConfirmation, Message: "Password and confirmation did not match."},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	user := &models.User{}
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		reset := &models.PasswordReset{}
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", token.Hash(req.Token), time.Now()).First(reset)
+		if err != nil {
+			return errResetTokenInvalid
+		}
+
+		n, err := tx.RawQuery(
+			"UPDATE password_resets SET used_at = ? WHERE id = ? AND used_at IS NULL",
+			time.Now(), reset.ID,
+		).ExecWithCount()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errResetTokenInvalid
+		}
+
+		err = tx.Scope(models.NotDeleted).Find(user, reset.UserID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errResetTokenInvalid
+		}
+		if err != nil {
+			return err
+		}
+
+		err = user.ChangePassword(tx, req.Password)
+		if err != nil {
+			return err
+		}
+
+		if err := models.RevokeUserRefreshTokens(tx, user.ID); err != nil {
+			return err
+		}
+		return user.RevokeTokens(tx)
+	})
+	if errors.Is(err, errResetTokenInvalid) {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"token": {"Reset token is invalid or expired"}},
+			Status: "error",
+		}))
+	}
+	if err != nil {
+		return err
+	}
+
+	cache.Cache.Delete(getAttemptsCacheKey(user.Email))
+
+	response := Response{
+		Data:   "Password has been reset",
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
@@ -0,0 +1,101 @@
+package actions
+
+import (
+	"coke/mailers"
+	"coke/models"
+	"errors"
+	"net/http"
+	"regexp"
+
+	"github.com/gobuffalo/buffalo/mail"
+)
+
+var linkTokenPattern = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+func (as *ActionSuite) Test_Password_Forgot_Unknown_Email() {
+	res := as.JSON("/auth/password/forgot").Post(&passwordForgot{Email: "nobody@mail.com"})
+	as.Equal(http.StatusAccepted, res.Result().StatusCode)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 0)
+}
+
+func (as *ActionSuite) Test_Password_Reset() {
+	err := NewAdmin(as)
+	if err != nil {
+		as.T().Fatal("failed creating new User Admin")
+	}
+	tokens := as.authenticate()
+
+	res := as.JSON("/auth/password/forgot").Post(&passwordForgot{Email: UserAdmin.Email})
+	as.Equal(http.StatusAccepted, res.Result().StatusCode)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 1)
+	as.Equal([]string{UserAdmin.Email}, messages[0].To)
+
+	match := linkTokenPattern.FindStringSubmatch(messages[0].Bodies[0].Content)
+	if match == nil {
+		as.FailNow("reset link not found in email")
+	}
+
+	reset := &passwordReset{
+		Token:                match[1],
+		Password:             "new password",
+		PasswordConfirmation: "new password",
+	}
+	res = as.JSON("/auth/password/reset").Post(reset)
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	res = as.JSON("/auth/password/reset").Post(reset)
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	res = as.JSON("/auth").Post(&credential{Email: UserAdmin.Email, Password: "new password"})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	res = as.JSON("/auth/refresh").Post(&refreshRequest{RefreshToken: tokens.RefreshToken})
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+
+	count, err := as.DB.Where("user_id = ? AND used_at IS NULL", UserAdmin.ID).Count(&models.PasswordReset{})
+	as.NoError(err)
+	as.Equal(0, count)
+	// Access tokens issued before the reset stop working too.
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, UserAdmin.ID))
+	as.True(user.TokensValidAfter.Valid)
+}
+
+type failingMailer struct{}
+
+func (failingMailer) Send(mail.Message) error {
+	return errors.New("smtp is down")
+}
+
+func (as *ActionSuite) Test_Password_Forgot_Mailer_Failure() {
+	as.NoError(NewAdmin(as))
+
+	mailers.Default = failingMailer{}
+	defer func() { mailers.Default = Outbox }()
+
+	res := as.JSON("/auth/password/forgot").Post(&passwordForgot{Email: UserAdmin.Email})
+	as.Equal(http.StatusAccepted, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Password_Reset_Deleted_User() {
+	as.NoError(NewAdmin(as))
+
+	res := as.JSON("/auth/password/forgot").Post(&passwordForgot{Email: UserAdmin.Email})
+	as.Equal(http.StatusAccepted, res.Result().StatusCode)
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	match := linkTokenPattern.FindStringSubmatch(messages[0].Bodies[0].Content)
+	if match == nil {
+		as.FailNow("reset link not found in email")
+	}
+
+	as.NoError(UserAdmin.SoftDelete(as.DB))
+	res = as.JSON("/auth/password/reset").Post(&passwordReset{Token: match[1], Password: "new password", PasswordConfirmation: "new password"})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+}
@@ -0,0 +1,49 @@
+package actions
+
+import (
+	"coke/internal/policy"
+	"coke/models"
+	"fmt"
+	"net/http"
+
+	"github.com/gobuffalo/buffalo"
+)
+
+// RequirePermission rejects callers whose roles do not grant permission.
+// API keys additionally need the matching scope, so a key never does more
+// than both its scopes and its owner allow.
+func RequirePermission(permission string) buffalo.MiddlewareFunc {
+	return func(next buffalo.Handler) buffalo.Handler {
+		return func(c buffalo.Context) error {
+			if !HasScope(c, permission) {
+				return forbidden(c, fmt.Errorf("API key is missing the %s scope", permission))
+			}
+
+			user, ok := c.Value("auth").(*models.User)
+			if !ok || !user.HasPermission(permission) {
+				return forbidden(c, fmt.Errorf("You do not have the %s permission", permission))
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// authorize checks the current user against the policy for action on
+// resource. API keys also need the action as a scope.
+func authorize(c buffalo.Context, action string, resource interface{}) error {
+	if !HasScope(c, action) {
+		return &policy.Denied{Reason: fmt.Sprintf("API key is missing the %s scope", action)}
+	}
+
+	user, _ := c.Value("auth").(*models.User)
+	return policy.Can(user, action, resource)
+}
+
+// forbidden renders a 403 with the reason the request was refused.
+func forbidden(c buffalo.Context, reason error) error {
+	return c.Render(http.StatusForbidden, r.JSON(Response{
+		Errors: reason.Error(),
+		Status: "error",
+	}))
+}
@@ -0,0 +1,106 @@
+package actions
+
+import (
+	"coke/models"
+	"fmt"
+	"net/http"
+
+	"github.com/gobuffalo/nulls"
+)
+
+func (as *ActionSuite) newUserWithLevel(email string, level int) (*models.User, string) {
+	user := &models.User{
+		Name:        "user",
+		Email:       email,
+		Password:    "password",
+		AccessLevel: nulls.NewInt(level),
+	}
+	as.NoError(as.DB.Create(user))
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
+
+	token, err := newAccessToken(user)
+	as.NoError(err)
+
+	return user, token
+}
+
+func (as *ActionSuite) Test_RequirePermission_Roles() {
+	as.NoError(NewAdmin(as))
+	_, member := as.newUserWithLevel("member@mail.com", 1)
+	_, viewer := as.newUserWithLevel("viewer@mail.com", 2)
+
+	req := as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", member)
+	res := req.Get()
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+	as.Contains(res.Body.String(), "users:read")
+
+	req = as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", viewer)
+	res = req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	req = as.JSON("/users/%d", UserAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", viewer)
+	res = req.Delete()
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_RequirePermission_APIKey_Limited_By_Owner() {
+	as.NoError(NewAdmin(as))
+	_, viewer := as.newUserWithLevel("viewer@mail.com", 2)
+	key := as.createAPIKey(viewer, "users:read", "users:delete")
+
+	req := as.JSON("/users/%d", UserAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", key.Token)
+	res := req.Delete()
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Users_Policy_Ownership() {
+	as.NoError(NewAdmin(as))
+	member, token := as.newUserWithLevel("member@mail.com", 1)
+
+	req := as.JSON("/users/%d", member.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	req = as.JSON("/users/%d", UserAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Get()
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+
+	req = as.JSON("/users/%d", member.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Put(&models.User{Name: "renamed", Email: member.Email})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	req = as.JSON("/users/%d", UserAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Put(&models.User{Name: "renamed", Email: UserAdmin.Email})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Users_Policy_Access_Level() {
+	as.NoError(NewAdmin(as))
+	_, token := as.newUserWithLevel("editor@mail.com", 3)
+
+	body := as.registration("new@mail.com")
+	req := as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(body)
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+	as.Contains(res.Body.String(), "higher than your own")
+
+	body.AccessLevel = nulls.NewInt(3)
+	req = as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Post(body)
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+
+	req = as.JSON("/users/%d", UserAdmin.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Put(&models.User{Name: "renamed", Email: UserAdmin.Email})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
@@ -0,0 +1,137 @@
+package actions
+
+import (
+	"coke/internal/cache"
+	"coke/models"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/validate"
+)
+
+// Registration modes accepted by REGISTRATION_MODE.
+const (
+	RegistrationOpen      = "open"
+	RegistrationAllowlist = "allowlist"
+	RegistrationDisabled  = "disabled"
+)
+
+var (
+	// RegistrationMode controls who may sign up through AuthRegister.
+	RegistrationMode = envy.Get("REGISTRATION_MODE", RegistrationDisabled)
+	// RegistrationAllowedDomains are the email domains accepted in
+	// allowlist mode, e.g. REGISTRATION_ALLOWED_DOMAINS=example.com,example.org.
+	RegistrationAllowedDomains = strings.Split(envy.Get("REGISTRATION_ALLOWED_DOMAINS", ""), ",")
+	// RegistrationAccessLevel is assigned to every self-registered user.
+	RegistrationAccessLevel = envInt("REGISTRATION_ACCESS_LEVEL", 1)
+	// RegistrationMaxAttempts is how many sign ups a single client address
+	// may attempt per RegistrationWindow.
+	RegistrationMaxAttempts = 5
+	RegistrationWindow      = time.Hour
+)
+
+// AuthRegister lets visitors create their own account. The access level
+// always comes from RegistrationAccessLevel, never from the request.
+func AuthRegister(c buffalo.Context) error {
+	if RegistrationMode != RegistrationOpen && RegistrationMode != RegistrationAllowlist {
+		return c.Error(http.StatusForbidden, errors.New("registration is disabled"))
+	}
+
+	attempts := 0
+	key := getRegistrationCacheKey(c.Request())
+	res, err := cache.Cache.Value(key)
+	if err == nil {
+		attempts = res.Data().(int)
+	}
+	if attempts >= RegistrationMaxAttempts {
+		return c.Render(http.StatusTooManyRequests, r.JSON(Response{
+			Errors: "Too many registrations. Please try again later",
+		}))
+	}
+	cache.Cache.Add(key, RegistrationWindow, attempts+1)
+
+	userJson := &userJson{}
+	if err := c.Bind(userJson); err != nil {
+		return err
+	}
+
+	verr := validate.Validate(userJson.validators(models.DB)...)
+	if RegistrationMode == RegistrationAllowlist && !emailDomainAllowed(userJson.Email) {
+		verr.Add("email", "Registration is not open for this email domain")
+	}
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	user := &models.User{
+		Name:                 userJson.Name,
+		Email:                userJson.Email,
+		Password:             userJson.Password,
+		PasswordConfirmation: userJson.PasswordConfirmation,
+		AccessLevel:          nulls.NewInt(RegistrationAccessLevel),
+	}
+	if RequireVerifiedEmail {
+		user.Status = models.StatusPending
+	}
+	err = models.DB.Create(user)
+	if err != nil {
+		return err
+	}
+
+	err = requestEmailVerification(user, user.Email)
+	if err != nil {
+		c.Logger().Errorf("failed sending verification email: %v", err)
+	}
+
+	response := Response{
+		Data:   user,
+		Status: "ok",
+	}
+	return c.Render(http.StatusCreated, r.JSON(response))
+}
+
+func emailDomainAllowed(email string) bool {
+	at := strings.LastIndex(email, "@")
+	if at < 0 {
+		return false
+	}
+
+	domain := strings.ToLower(email[at+1:])
+	for _, allowed := range RegistrationAllowedDomains {
+		if allowed = strings.ToLower(strings.TrimSpace(allowed)); allowed != "" && domain == allowed {
+			return true
+		}
+	}
+
+	return false
+}
+
+func getRegistrationCacheKey(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return fmt.Sprintf("register:%s", host)
+}
+
+func envInt(key string, fallback int) int {
+	v, err := strconv.Atoi(envy.Get(key, ""))
+	if err != nil {
+		return fallback
+	}
+
+	return v
+}
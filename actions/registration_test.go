@@ -0,0 +1,75 @@
+package actions
+
+import (
+	"coke/models"
+	"net/http"
+
+	"github.com/gobuffalo/nulls"
+)
+
+func (as *ActionSuite) registration(email string) userJson {
+	return userJson{
+		Name:                 "new user",
+		Email:                email,
+		Password:             "password",
+		PasswordConfirmation: "password",
+		AccessLevel:          nulls.NewInt(4),
+	}
+}
+
+func (as *ActionSuite) Test_Auth_Register_Disabled() {
+	RegistrationMode = RegistrationDisabled
+
+	res := as.JSON("/auth/register").Post(as.registration("user@mail.com"))
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Auth_Register_Open() {
+	RegistrationMode = RegistrationOpen
+	defer func() { RegistrationMode = RegistrationDisabled }()
+
+	res := as.JSON("/auth/register").Post(as.registration("user@mail.com"))
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+
+	user := &models.User{}
+	err := as.DB.Where("email = ?", "user@mail.com").First(user)
+	if err != nil {
+		as.FailNow("failed finding records", err)
+	}
+	as.Equal(RegistrationAccessLevel, user.AccessLevel.Int)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 1)
+
+	res = as.JSON("/auth/register").Post(as.registration("user@mail.com"))
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Auth_Register_Allowlist() {
+	RegistrationMode = RegistrationAllowlist
+	RegistrationAllowedDomains = []string{"example.com"}
+	defer func() {
+		RegistrationMode = RegistrationDisabled
+		RegistrationAllowedDomains = nil
+	}()
+
+	res := as.JSON("/auth/register").Post(as.registration("user@mail.com"))
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	res = as.JSON("/auth/register").Post(as.registration("user@Example.com"))
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Auth_Register_Rate_Limited() {
+	RegistrationMode = RegistrationOpen
+	defer func() { RegistrationMode = RegistrationDisabled }()
+
+	for i := 0; i < RegistrationMaxAttempts; i++ {
+		res := as.JSON("/auth/register").Post(userJson{})
+		as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+	}
+
+	res := as.JSON("/auth/register").Post(as.registration("user@mail.com"))
+	as.Equal(http.StatusTooManyRequests, res.Result().StatusCode)
+}
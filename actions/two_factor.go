@@ -0,0 +1,392 @@
+package actions
+
+import (
+	"coke/internal/cache"
+	"coke/internal/totp"
+	"coke/models"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// MFATokenLifetime is how long a user has to enter their second factor
+// after a successful password check.
+var MFATokenLifetime = 5 * time.Minute
+
+// TwoFactorRequiredLevels lists the access levels that must enroll in
+// two-factor authentication, e.g. MFA_REQUIRED_ACCESS_LEVELS=3,4.
+var TwoFactorRequiredLevels = parseAccessLevels(envy.Get("MFA_REQUIRED_ACCESS_LEVELS", ""))
+
+type mfaChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+type twoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type twoFactorPassword struct {
+	Password string `json:"password"`
+}
+
+type twoFactorCode struct {
+	Code string `json:"code"`
+}
+
+type twoFactorVerification struct {
+	MFAToken     string `json:"mfa_token"`
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+// TwoFactorSetup starts enrollment by generating a new TOTP secret. It is
+// not active until confirmed with a code from the authenticator app. The
+// current password is required, so a stolen access token can not tie the
+// account to an authenticator the owner does not have.
+func TwoFactorSetup(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	auth := c.Value("auth").(*models.User)
+	if auth.TwoFactorEnabled() {
+		return c.Error(http.StatusConflict, errors.New("two-factor authentication is already enabled"))
+	}
+
+	req := &twoFactorPassword{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	verr := validate.Validate(
+		&validators.StringIsPresent{Field: req.Password, Name: "password"},
+	)
+	if req.Password != "" {
+		ok, err := verifyPassword(c, auth, req.Password)
+		if errors.Is(err, errTooManyAttempts) {
+			return tooManyAttempts(c)
+		}
+		if !ok {
+			verr.Add("password", "Password is incorrect.")
+		}
+	}
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return err
+	}
+
+	err = auth.SealTOTPSecret(TOTPSecrets, secret)
+	if err != nil {
+		return err
+	}
+	err = models.DB.UpdateColumns(auth, "totp_secret")
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data: twoFactorSetup{
+			Secret: secret,
+			URI:    totp.URI(envy.Get("TOTP_ISSUER", app.Name), auth.Email, secret),
+		},
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// TwoFactorConfirm enables two-factor authentication once the user proves
+// their authenticator produces valid codes, and returns the recovery codes.
+func TwoFactorConfirm(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	auth := c.Value("auth").(*models.User)
+	if auth.TwoFactorEnabled() {
+		return c.Error(http.StatusConflict, errors.New("two-factor authentication is already enabled"))
+	}
+	if !auth.TOTPSecret.Valid {
+		return c.Error(http.StatusBadRequest, errors.New("two-factor setup has not been started"))
+	}
+
+	req := &twoFactorCode{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	if !checkTOTP(auth, req.Code) {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"code": {"Code is invalid"}},
+			Status: "error",
+		}))
+	}
+
+	var codes []string
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		auth.TOTPEnabledAt = nulls.NewTime(time.Now())
+		err := tx.UpdateColumns(auth, "totp_enabled_at")
+		if err != nil {
+			return err
+		}
+
+		codes, err = models.GenerateRecoveryCodes(tx, auth.ID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   map[string][]string{"recovery_codes": codes},
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// TwoFactorDelete turns two-factor authentication off. A current code is
+// required, and users whose access level mandates it can not opt out.
+func TwoFactorDelete(c buffalo.Context) error {
+	if usingAPIKey(c) {
+		return c.Error(http.StatusForbidden, errSessionRequired)
+	}
+
+	auth := c.Value("auth").(*models.User)
+	if !auth.TwoFactorEnabled() {
+		return c.Error(http.StatusBadRequest, errors.New("two-factor authentication is not enabled"))
+	}
+	if twoFactorRequired(auth) {
+		return c.Error(http.StatusForbidden, errors.New("two-factor authentication is required for your access level"))
+	}
+
+	req := &twoFactorCode{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	if !checkTOTP(auth, req.Code) {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"code": {"Code is invalid"}},
+			Status: "error",
+		}))
+	}
+
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		auth.TOTPSecret = nulls.String{}
+		auth.TOTPEnabledAt = nulls.Time{}
+		err := tx.UpdateColumns(auth, "totp_secret", "totp_enabled_at")
+		if err != nil {
+			return err
+		}
+
+		return tx.RawQuery("DELETE FROM recovery_codes WHERE user_id = ?", auth.ID).Exec()
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusNoContent, nil)
+}
+
+// TwoFactorVerify is the second login step. It exchanges the mfa pending
+// token from AuthCreate plus a TOTP or recovery code for a token pair.
+func TwoFactorVerify(c buffalo.Context) error {
+	req := &twoFactorVerification{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	verr := validate.Validate(
+		&validators.StringIsPresent{Name: "mfa_token", Field: req.MFAToken},
+	)
+	if req.Code == "" && req.RecoveryCode == "" {
+		verr.Add("code", "Code or recovery code must be present.")
+	}
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	user, err := parseMFAToken(req.MFAToken)
+	if err != nil {
+		return c.Render(http.StatusUnauthorized, r.JSON(Response{
+			Errors: "MFA token is invalid or expired",
+			Status: "error",
+		}))
+	}
+	if !user.Active() {
+		return inactiveAccount(c, user)
+	}
+
+	attempts := 0
+	res, err := cache.Cache.Value(getMFAAttemptsCacheKey(user.ID))
+	if err == nil {
+		attempts = res.Data().(int)
+	}
+	if attempts >= MaxAttempts {
+		return c.Render(http.StatusTooManyRequests, r.JSON(Response{
+			Errors: "Too many attempts. Please try again later",
+		}))
+	}
+
+	valid := false
+	if req.RecoveryCode != "" {
+		valid, err = models.UseRecoveryCode(models.DB, user.ID, req.RecoveryCode)
+		if err != nil {
+			return err
+		}
+	} else {
+		valid = checkTOTP(user, req.Code)
+	}
+
+	if !valid {
+		cache.Cache.Add(getMFAAttemptsCacheKey(user.ID), LockoutDuration, attempts+1)
+		if attempts+1 >= MaxAttempts {
+			lockAccount(c, user)
+		}
+		return c.Render(http.StatusUnauthorized, r.JSON(Response{
+			Errors: "Code is invalid",
+			Status: "error",
+		}))
+	}
+
+	cache.Cache.Delete(getMFAAttemptsCacheKey(user.ID))
+
+	return startSession(c, user)
+}
+
+// RequireTwoFactor keeps users whose access level mandates two-factor
+// authentication away from everything but enrollment until they enable it.
+func RequireTwoFactor(next buffalo.Handler) buffalo.Handler {
+	return func(c buffalo.Context) error {
+		auth, ok := c.Value("auth").(*models.User)
+		if ok && twoFactorRequired(auth) && !auth.TwoFactorEnabled() {
+			return c.Render(http.StatusForbidden, r.JSON(Response{
+				Errors: "Two-factor authentication must be enabled for this account",
+				Status: "error",
+			}))
+		}
+
+		return next(c)
+	}
+}
+
+// completeLogin finishes a successful password check. Users with two-factor
+// authentication receive an mfa pending token instead of a session, and
+// accounts that are not active are refused.
+func completeLogin(c buffalo.Context, user *models.User) error {
+	if !user.Active() {
+		return inactiveAccount(c, user)
+	}
+
+	if !user.TwoFactorEnabled() {
+		return startSession(c, user)
+	}
+
+	mfaToken, err := newMFAToken(user)
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, r.JSON(mfaChallenge{
+		MFARequired: true,
+		MFAToken:    mfaToken,
+		ExpiresIn:   int64(MFATokenLifetime.Seconds()),
+	}))
+}
+
+func newMFAToken(user *models.User) (string, error) {
+	now := time.Now()
+	claims := jwt.MapClaims{}
+	claims["typ"] = "mfa_pending"
+	claims["user_id"] = user.ID
+	claims["iat"] = now.Unix()
+	claims["exp"] = now.Add(MFATokenLifetime).Unix()
+	return Keys.Sign(claims)
+}
+
+func parseMFAToken(tokenString string) (*models.User, error) {
+	t, err := jwt.Parse(tokenString, Keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+
+	claims := t.Claims.(jwt.MapClaims)
+	if claims["typ"] != "mfa_pending" {
+		return nil, errors.New("not an mfa token")
+	}
+
+	user := &models.User{}
+	err = models.DB.Scope(models.NotDeleted).Find(user, claims["user_id"])
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// checkTOTP validates a code against the user's secret and refuses to accept
+// the same time step twice, so an observed code can not be replayed.
+func checkTOTP(user *models.User, code string) bool {
+	if !user.TOTPSecret.Valid {
+		return false
+	}
+
+	secret, err := user.OpenTOTPSecret(TOTPSecrets)
+	if err != nil {
+		log.Printf("failed opening the TOTP secret of user %d: %v", user.ID, err)
+		return false
+	}
+
+	step, ok := totp.Validate(secret, code, time.Now())
+	if !ok {
+		return false
+	}
+
+	key := fmt.Sprintf("totp:%d:%d", user.ID, step)
+	if cache.Cache.Exists(key) {
+		return false
+	}
+	cache.Cache.Add(key, (totp.Skew*2+1)*totp.Period*time.Second, true)
+
+	return true
+}
+
+func twoFactorRequired(user *models.User) bool {
+	return user.AccessLevel.Valid && TwoFactorRequiredLevels[user.AccessLevel.Int]
+}
+
+func parseAccessLevels(s string) map[int]bool {
+	levels := map[int]bool{}
+	for _, v := range strings.Split(s, ",") {
+		level, err := strconv.Atoi(strings.TrimSpace(v))
+		if err == nil {
+			levels[level] = true
+		}
+	}
+
+	return levels
+}
@@ -0,0 +1,215 @@
+package actions
+
+import (
+	"coke/internal/secretbox"
+	"coke/internal/totp"
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// enrollTwoFactor enables 2FA for the admin and returns the secret and
+// recovery codes.
+func (as *ActionSuite) enrollTwoFactor(token string) (string, []string) {
+	req := as.JSON("/auth/2fa/setup")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(&twoFactorPassword{Password: "password"})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var setup struct {
+		Data twoFactorSetup `json:"data"`
+	}
+	err := json.Unmarshal(res.Body.Bytes(), &setup)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+	as.Contains(setup.Data.URI, "otpauth://totp/")
+
+	// Use the previous step so the current one is still free for login.
+	code, err := totp.Code(setup.Data.Secret, time.Now().Add(-totp.Period*time.Second))
+	if err != nil {
+		as.FailNow("failed generating code", err)
+	}
+
+	req = as.JSON("/auth/2fa/confirm")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Post(&twoFactorCode{Code: code})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var confirm struct {
+		Data map[string][]string `json:"data"`
+	}
+	err = json.Unmarshal(res.Body.Bytes(), &confirm)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+
+	return setup.Data.Secret, confirm.Data["recovery_codes"]
+}
+
+func (as *ActionSuite) mfaChallenge() mfaChallenge {
+	res := as.JSON("/auth").Post(&credential{
+		Email:    UserAdmin.Email,
+		Password: "password",
+	})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var challenge mfaChallenge
+	err := json.Unmarshal(res.Body.Bytes(), &challenge)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+	as.True(challenge.MFARequired)
+
+	return challenge
+}
+
+func (as *ActionSuite) Test_TwoFactor_Login() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	secret, codes := as.enrollTwoFactor(token)
+	as.Len(codes, 10)
+
+	challenge := as.mfaChallenge()
+
+	req := as.JSON("/auth")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", challenge.MFAToken)
+	res := req.Get()
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		as.FailNow("failed generating code", err)
+	}
+
+	res = as.JSON("/auth/2fa/verify").Post(&twoFactorVerification{MFAToken: challenge.MFAToken, Code: code})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	var tokens tokenPair
+	err = json.Unmarshal(res.Body.Bytes(), &tokens)
+	if err != nil {
+		as.FailNow("unmarshal failed", err)
+	}
+
+	req = as.JSON("/auth")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", tokens.Token)
+	res = req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	res = as.JSON("/auth/2fa/verify").Post(&twoFactorVerification{MFAToken: challenge.MFAToken, Code: code})
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_TwoFactor_Recovery_Code_Single_Use() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	_, codes := as.enrollTwoFactor(token)
+	challenge := as.mfaChallenge()
+
+	res := as.JSON("/auth/2fa/verify").Post(&twoFactorVerification{MFAToken: challenge.MFAToken, RecoveryCode: codes[0]})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	res = as.JSON("/auth/2fa/verify").Post(&twoFactorVerification{MFAToken: challenge.MFAToken, RecoveryCode: codes[0]})
+	as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_TwoFactor_Setup_Requires_Password() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	for _, body := range []*twoFactorPassword{{}, {Password: "wrong"}} {
+		req := as.JSON("/auth/2fa/setup")
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := req.Post(body)
+		as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+		as.Contains(res.Body.String(), "password")
+	}
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, UserAdmin.ID))
+	as.False(user.TOTPSecret.Valid)
+}
+
+func (as *ActionSuite) Test_TwoFactor_Code_Guesses_Lock_Account() {
+	token, err := Login(as)
+	as.NoError(err)
+	as.enrollTwoFactor(token)
+
+	// Signing in again between guesses does not reset the count.
+	for i := 0; i < MaxAttempts; i++ {
+		challenge := as.mfaChallenge()
+		res := as.JSON("/auth/2fa/verify").Post(&twoFactorVerification{MFAToken: challenge.MFAToken, Code: "000000"})
+		as.Equal(http.StatusUnauthorized, res.Result().StatusCode)
+	}
+
+	res := as.JSON("/auth").Post(&credential{Email: UserAdmin.Email, Password: "password"})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+	as.Equal("account_locked", as.errorCode(res))
+}
+
+func (as *ActionSuite) Test_TwoFactor_Required_For_Access_Level() {
+	TwoFactorRequiredLevels = map[int]bool{4: true}
+	defer func() { TwoFactorRequiredLevels = map[int]bool{} }()
+
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	req := as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Get()
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+
+	as.enrollTwoFactor(token)
+
+	req = as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res = req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_TwoFactor_Secret_Encrypted() {
+	token, err := Login(as)
+	as.NoError(err)
+	secret, _ := as.enrollTwoFactor(token)
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, UserAdmin.ID))
+	as.True(secretbox.Sealed(user.TOTPSecret.String))
+	as.NotContains(user.TOTPSecret.String, secret)
+
+	verify := func(at time.Time) int {
+		code, err := totp.Code(secret, at)
+		as.NoError(err)
+		challenge := as.mfaChallenge()
+		res := as.JSON("/auth/2fa/verify").Post(&twoFactorVerification{MFAToken: challenge.MFAToken, Code: code})
+		return res.Result().StatusCode
+	}
+
+	// Secrets stored before encryption keep working until they are sealed.
+	err = as.DB.RawQuery("UPDATE users SET totp_secret = ? WHERE id = ?", secret, UserAdmin.ID).Exec()
+	as.NoError(err)
+	as.Equal(http.StatusOK, verify(time.Now()))
+
+	n, err := models.EncryptTOTPSecrets(as.DB, TOTPSecrets)
+	as.NoError(err)
+	as.Equal(1, n)
+	as.NoError(as.DB.Reload(user))
+	as.True(secretbox.Sealed(user.TOTPSecret.String))
+	as.Equal(http.StatusOK, verify(time.Now().Add(totp.Period*time.Second)))
+
+	// A sealed secret copied to another account does not open there.
+	member, _ := as.newUserWithLevel("member@mail.com", 1)
+	member.TOTPSecret = user.TOTPSecret
+	_, err = member.OpenTOTPSecret(TOTPSecrets)
+	as.ErrorIs(err, secretbox.ErrOpen)
+}
@@ -0,0 +1,142 @@
+package actions
+
+import (
+	"coke/internal/cache"
+	"coke/internal/policy"
+	"coke/models"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+	"github.com/gobuffalo/validate/v3/validators"
+)
+
+type suspendJson struct {
+	Reason string     `json:"reason"`
+	Until  nulls.Time `json:"until"`
+}
+
+type reactivateJson struct {
+	Reason string `json:"reason"`
+}
+
+// Suspend stops a user from signing in or using their tokens. With until
+// set the suspension lifts on its own at that time.
+func (u UserResource) Suspend(c buffalo.Context) error {
+	req := &suspendJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	verr := validate.Validate(
+		&validators.StringIsPresent{Field: req.Reason, Name: "reason"},
+		&validators.StringLengthInRange{Name: "reason", Field: req.Reason, Min: 0, Max: 255},
+	)
+	if req.Until.Valid && !req.Until.Time.After(time.Now()) {
+		verr.Add("until", "Until must be in the future")
+	}
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	return changeStatus(c, models.StatusSuspended, req.Reason, req.Until)
+}
+
+// Reactivate lifts a suspension or lock ahead of its expiry.
+func (u UserResource) Reactivate(c buffalo.Context) error {
+	req := &reactivateJson{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+
+	verr := validate.Validate(
+		&validators.StringLengthInRange{Name: "reason", Field: req.Reason, Min: 0, Max: 255},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	return changeStatus(c, models.StatusActive, req.Reason, nulls.Time{})
+}
+
+func changeStatus(c buffalo.Context, status, reason string, until nulls.Time) error {
+	user := &models.User{}
+	err := models.DB.Scope(scopeUsers(c)).Find(user, c.Param("user_id"))
+	if err != nil {
+		return err
+	}
+
+	if !HasScope(c, policy.UpdateUser) {
+		return forbidden(c, fmt.Errorf("API key is missing the %s scope", policy.UpdateUser))
+	}
+	auth := c.Value("auth").(*models.User)
+	if err := policy.CanChangeStatus(auth, user); err != nil {
+		return forbidden(c, err)
+	}
+	// The status signs the user out of every organization.
+	owned, err := accountOwned(c, user)
+	if err != nil {
+		return err
+	}
+	if !owned {
+		return forbidden(c, errSharedAccount)
+	}
+
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		if status != models.StatusActive {
+			if err := keepTopAdmin(tx, currentOrganization(c), user); err != nil {
+				return err
+			}
+		}
+
+		return user.SetStatus(tx, status, reason, until)
+	})
+	if errors.Is(err, errLastAdmin) {
+		return lastAdmin(c)
+	}
+	var terr *models.StatusTransitionError
+	if errors.As(err, &terr) {
+		return c.Render(http.StatusConflict, r.JSON(Response{
+			Errors: terr.Error(),
+			Status: "error",
+		}))
+	}
+	if err != nil {
+		return err
+	}
+	if status == models.StatusActive {
+		// The failed sign in counters would otherwise keep a lifted lock.
+		cache.Cache.Delete(getAttemptsCacheKey(user.Email))
+		cache.Cache.Delete(getMFAAttemptsCacheKey(user.ID))
+	}
+
+	response := Response{
+		Data:   user,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// statusClause filters users by the status in force.
+func statusClause(op string, value interface{}) (string, []interface{}, error) {
+	status := value.(string)
+	if !models.ValidStatus(status) {
+		return "", nil, fmt.Errorf("%q is not an account status", status)
+	}
+
+	where, args := models.StatusCondition(status, time.Now())
+	return where, args, nil
+}
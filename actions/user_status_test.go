@@ -0,0 +1,209 @@
+package actions
+
+import (
+	"coke/models"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/httptest"
+	"github.com/gobuffalo/nulls"
+)
+
+func (as *ActionSuite) setStatus(token string, id int, action string, body map[string]interface{}) int {
+	req := as.JSON("/users/%d/%s", id, action)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	return req.Post(body).Result().StatusCode
+}
+
+func (as *ActionSuite) getMe(token string) *httptest.JSONResponse {
+	req := as.JSON("/me")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	return req.Get()
+}
+
+func (as *ActionSuite) errorCode(res *httptest.JSONResponse) string {
+	response := Response{}
+	as.NoError(json.Unmarshal(res.Body.Bytes(), &response))
+	return response.Code
+}
+
+func (as *ActionSuite) Test_Users_Suspend_Reactivate() {
+	token, err := Login(as)
+	as.NoError(err)
+	member, memberToken := as.newUserWithLevel("member@mail.com", 1)
+
+	code := as.setStatus(token, member.ID, "suspend", map[string]interface{}{"reason": "spam"})
+	as.Equal(http.StatusOK, code)
+
+	user := &models.User{}
+	as.NoError(as.DB.Find(user, member.ID))
+	as.Equal(models.StatusSuspended, user.Status)
+	as.Equal("spam", user.StatusReason.String)
+
+	res := as.getMe(memberToken)
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+	as.Equal("account_suspended", as.errorCode(res))
+
+	res = as.JSON("/auth").Post(&credential{Email: member.Email, Password: "password"})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+	as.Equal("account_suspended", as.errorCode(res))
+
+	as.Equal(http.StatusConflict, as.setStatus(token, member.ID, "suspend", map[string]interface{}{"reason": "again"}))
+	as.Equal(http.StatusForbidden, as.setStatus(token, UserAdmin.ID, "suspend", map[string]interface{}{"reason": "me"}))
+	as.Equal(http.StatusUnprocessableEntity, as.setStatus(token, member.ID, "suspend", map[string]interface{}{}))
+
+	as.Equal(http.StatusOK, as.setStatus(token, member.ID, "reactivate", map[string]interface{}{"reason": "appeal"}))
+	as.Equal(http.StatusConflict, as.setStatus(token, member.ID, "reactivate", map[string]interface{}{}))
+
+	res = as.getMe(memberToken)
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Users_Suspend_Shared_Account() {
+	token, err := Login(as)
+	as.NoError(err)
+	member, memberToken := as.newUserWithLevel("member@mail.com", 1)
+	other, _ := as.newOtherOrganization()
+	as.NoError(models.AddMember(as.DB, other.ID, member))
+
+	as.Equal(http.StatusForbidden, as.setStatus(token, member.ID, "suspend", map[string]interface{}{"reason": "spam"}))
+
+	res := as.getMe(memberToken)
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Users_Suspension_Expires() {
+	token, err := Login(as)
+	as.NoError(err)
+	member, memberToken := as.newUserWithLevel("member@mail.com", 1)
+
+	past := map[string]interface{}{"reason": "spam", "until": time.Now().Add(-time.Hour)}
+	as.Equal(http.StatusUnprocessableEntity, as.setStatus(token, member.ID, "suspend", past))
+
+	until := map[string]interface{}{"reason": "spam", "until": time.Now().Add(time.Hour)}
+	as.Equal(http.StatusOK, as.setStatus(token, member.ID, "suspend", until))
+
+	list := func(status string) (int, []models.User) {
+		req := as.JSON("/users?filter[status]=%s", status)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := req.Get()
+		var body struct {
+			Data []models.User `json:"data"`
+		}
+		as.NoError(json.Unmarshal(res.Body.Bytes(), &body))
+		return res.Result().StatusCode, body.Data
+	}
+
+	code, users := list(models.StatusSuspended)
+	as.Equal(http.StatusOK, code)
+	as.Len(users, 1)
+	as.Equal(member.ID, users[0].ID)
+
+	res := as.getMe(memberToken)
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+
+	err = as.DB.RawQuery("UPDATE users SET status_until = ? WHERE id = ?", time.Now().Add(-time.Minute), member.ID).Exec()
+	as.NoError(err)
+
+	res = as.getMe(memberToken)
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	code, users = list(models.StatusSuspended)
+	as.Equal(http.StatusOK, code)
+	as.Len(users, 0)
+	_, users = list(models.StatusActive)
+	as.Len(users, 2)
+
+	// Listing reads the lapse without writing it back.
+	var stored string
+	as.NoError(as.DB.RawQuery("SELECT status FROM users WHERE id = ?", member.ID).First(&stored))
+	as.Equal(models.StatusSuspended, stored)
+
+	code, _ = list("banned")
+	as.Equal(http.StatusUnprocessableEntity, code)
+}
+
+func (as *ActionSuite) Test_Auth_Create_Locks_Account() {
+	token, err := Login(as)
+	as.NoError(err)
+	member, memberToken := as.newUserWithLevel("member@mail.com", 1)
+
+	for i := 0; i < MaxAttempts; i++ {
+		res := as.JSON("/auth").Post(&credential{Email: "member@mail.com", Password: "wrong"})
+		as.NotEqual(http.StatusOK, res.Result().StatusCode)
+	}
+
+	user := &models.User{}
+	as.NoError(as.DB.Where("email = ?", "member@mail.com").First(user))
+	as.Equal(models.StatusLocked, user.Status)
+	as.True(user.StatusUntil.Valid)
+
+	// The lock stops new sign ins only, existing sessions carry on.
+	res := as.getMe(memberToken)
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	res = as.JSON("/auth").Post(&credential{Email: "member@mail.com", Password: "password"})
+	as.NotEqual(http.StatusOK, res.Result().StatusCode)
+
+	as.Equal(http.StatusOK, as.setStatus(token, member.ID, "reactivate", map[string]interface{}{}))
+	res = as.JSON("/auth").Post(&credential{Email: "member@mail.com", Password: "password"})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Auth_Register_Pending_Until_Verified() {
+	RegistrationMode = RegistrationOpen
+	RequireVerifiedEmail = true
+	defer func() {
+		RegistrationMode = RegistrationDisabled
+		RequireVerifiedEmail = false
+	}()
+
+	res := as.JSON("/auth/register").Post(as.registration("user@mail.com"))
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+
+	user := &models.User{}
+	as.NoError(as.DB.Where("email = ?", "user@mail.com").First(user))
+	as.Equal(models.StatusPending, user.Status)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	match := linkTokenPattern.FindStringSubmatch(messages[0].Bodies[0].Content)
+	if match == nil {
+		as.FailNow("verification link not found in email")
+	}
+	res = as.JSON("/auth/verify").Post(&emailVerify{Token: match[1]})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	as.NoError(as.DB.Reload(user))
+	as.Equal(models.StatusActive, user.Status)
+
+	res = as.JSON("/auth").Post(&credential{Email: user.Email, Password: "password"})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+}
+
+func (as *ActionSuite) Test_Inactive_Account_Login_Paths() {
+	token, err := Login(as)
+	as.NoError(err)
+	_, codes := as.enrollTwoFactor(token)
+	challenge := as.mfaChallenge()
+
+	as.NoError(UserAdmin.SetStatus(as.DB, models.StatusSuspended, "spam", nulls.Time{}))
+	res := as.JSON("/auth/2fa/verify").Post(&twoFactorVerification{MFAToken: challenge.MFAToken, RecoveryCode: codes[0]})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+	as.Equal("account_suspended", as.errorCode(res))
+
+	m := as.newMockIssuer(true)
+	rec := as.oidcLogin(m)
+	as.Equal(http.StatusOK, rec.Code, rec.Body.String())
+	user := &models.User{}
+	as.NoError(as.DB.Where("email = ?", m.email).First(user))
+
+	as.NoError(user.SetStatus(as.DB, models.StatusSuspended, "spam", nulls.Time{}))
+	rec = as.oidcLogin(m)
+	as.Equal(http.StatusForbidden, rec.Code)
+	response := Response{}
+	as.NoError(json.Unmarshal(rec.Body.Bytes(), &response))
+	as.Equal("account_suspended", response.Code)
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"net/http"
 
+	"github.com/gobuffalo/httptest"
 	"github.com/gobuffalo/nulls"
 )
 
@@ -52,6 +53,7 @@ func (as *ActionSuite) Test_Users_Show() {
 	if err != nil {
 		as.T().Fatal("error creating user")
 	}
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
 
 	req := as.JSON(fmt.Sprintf("/users/%d", user.ID))
 	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
@@ -113,6 +115,7 @@ func (as *ActionSuite) Test_Users_Update() {
 	if err != nil {
 		as.T().Fatal("error creating user")
 	}
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
 
 	token, err := Login(as)
 	if err != nil {
@@ -135,8 +138,96 @@ func (as *ActionSuite) Test_Users_Update() {
 		as.T().Fatal("failed finding records")
 	}
 
-	as.Equal(body.Email, updated.Email)
+	as.Equal(user.Email, updated.Email)
+	as.Equal(body.Email, updated.PendingEmail.String)
 	as.Equal(body.Name, updated.Name)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 1)
+	as.Equal([]string{body.Email}, messages[0].To)
+
+	match := linkTokenPattern.FindStringSubmatch(messages[0].Bodies[0].Content)
+	if match == nil {
+		as.FailNow("verification link not found in email")
+	}
+
+	res = as.JSON("/auth/verify").Post(&emailVerify{Token: match[1]})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	err = as.DB.Find(updated, user.ID)
+	if err != nil {
+		as.T().Fatal("failed finding records")
+	}
+
+	as.Equal(body.Email, updated.Email)
+	as.False(updated.PendingEmail.Valid)
+	as.True(updated.VerifiedAt.Valid)
+}
+
+func (as *ActionSuite) Test_Users_Patch() {
+	user := &models.User{Name: "user", Email: "email@mail.com", Password: "password", AccessLevel: nulls.NewInt(1)}
+	as.NoError(as.DB.Create(user))
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
+
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	patch := func(contentType string, body interface{}) (int, map[string]interface{}) {
+		req := as.JSON("/users/%d", user.ID)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		req.Headers["Content-Type"] = contentType
+		res := req.Patch(body)
+
+		response := map[string]interface{}{}
+		as.NoError(json.Unmarshal(res.Body.Bytes(), &response))
+		return res.Result().StatusCode, response
+	}
+
+	code, res := patch("application/merge-patch+json", map[string]interface{}{"name": "merged"})
+	as.Equal(http.StatusOK, code)
+	as.Equal("merged", res["data"].(map[string]interface{})["name"])
+	as.Equal("email@mail.com", res["data"].(map[string]interface{})["email"])
+
+	code, _ = patch("application/json-patch+json", []map[string]interface{}{
+		{"op": "test", "path": "/name", "value": "merged"},
+		{"op": "replace", "path": "/email", "value": "patched@mail.com"},
+	})
+	as.Equal(http.StatusOK, code)
+
+	updated := &models.User{}
+	as.NoError(as.DB.Find(updated, user.ID))
+	as.Equal("merged", updated.Name)
+	as.Equal("email@mail.com", updated.Email)
+	as.Equal("patched@mail.com", updated.PendingEmail.String)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 1)
+
+	code, _ = patch("application/json-patch+json", []map[string]interface{}{
+		{"op": "test", "path": "/name", "value": "stale"},
+		{"op": "replace", "path": "/name", "value": "lost"},
+	})
+	as.Equal(http.StatusConflict, code)
+
+	code, res = patch("application/merge-patch+json", map[string]interface{}{"access_level": 4, "password": "x"})
+	as.Equal(http.StatusUnprocessableEntity, code)
+	as.Contains(res["errors"], "access_level")
+	as.Contains(res["errors"], "password")
+
+	code, res = patch("application/merge-patch+json", map[string]interface{}{"name": nil})
+	as.Equal(http.StatusUnprocessableEntity, code)
+	as.Contains(res["errors"], "name")
+
+	code, _ = patch("application/json", map[string]interface{}{"name": "plain"})
+	as.Equal(http.StatusUnsupportedMediaType, code)
+
+	as.NoError(as.DB.Find(updated, user.ID))
+	as.Equal("merged", updated.Name)
+	as.Equal(1, updated.AccessLevel.Int)
 }
 
 func (as *ActionSuite) Test_Users_Delete() {
@@ -149,6 +240,7 @@ func (as *ActionSuite) Test_Users_Delete() {
 	if err != nil {
 		as.T().Fatal("error creating user")
 	}
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
 
 	token, err := Login(as)
 	if err != nil {
@@ -161,7 +253,7 @@ func (as *ActionSuite) Test_Users_Delete() {
 
 	as.Equal(http.StatusNoContent, res.Result().StatusCode)
 
-	count, err := as.DB.Where("id = ?", user.ID).Count(&models.User{})
+	count, err := as.DB.Scope(models.NotDeleted).Where("id = ?", user.ID).Count(&models.User{})
 	if err != nil {
 		as.T().Fatal("failed to count records")
 	}
@@ -169,6 +261,77 @@ func (as *ActionSuite) Test_Users_Delete() {
 	as.Equal(0, count)
 }
 
+func (as *ActionSuite) Test_Users_Soft_Delete_Restore() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	user := &models.User{Name: "user", Email: "email@mail.com", Password: "password"}
+	as.NoError(as.DB.Create(user))
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
+	userToken, err := newAccessToken(user)
+	as.NoError(err)
+
+	get := func(path, bearer string) (int, []int) {
+		req := as.JSON(path)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", bearer)
+		res := req.Get()
+
+		var body struct {
+			Data []models.User `json:"data"`
+		}
+		json.Unmarshal(res.Body.Bytes(), &body)
+		ids := []int{}
+		for _, u := range body.Data {
+			ids = append(ids, u.ID)
+		}
+		return res.Result().StatusCode, ids
+	}
+	restore := func() int {
+		req := as.JSON("/users/%d/restore", user.ID)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		return req.Post(nil).Result().StatusCode
+	}
+
+	req := as.JSON("/users/%d", user.ID)
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	as.Equal(http.StatusNoContent, req.Delete().Result().StatusCode)
+
+	// The row is kept, but the account is gone from the API.
+	count, err := as.DB.Where("id = ?", user.ID).Count(&models.User{})
+	as.NoError(err)
+	as.Equal(1, count)
+	_, ids := get("/users", token)
+	as.Equal([]int{UserAdmin.ID}, ids)
+	code, _ := get(fmt.Sprintf("/users/%d", user.ID), token)
+	as.Equal(http.StatusNotFound, code)
+	code, _ = get("/auth", userToken)
+	as.Equal(http.StatusUnauthorized, code)
+
+	res := as.JSON("/auth").Post(&credential{Email: user.Email, Password: "password"})
+	as.NotEqual(http.StatusOK, res.Result().StatusCode)
+
+	_, ids = get("/users?deleted=only", token)
+	as.Equal([]int{user.ID}, ids)
+	code, _ = get("/users?deleted=all", token)
+	as.Equal(http.StatusUnprocessableEntity, code)
+
+	as.Equal(http.StatusOK, restore())
+	code, _ = get("/auth", userToken)
+	as.Equal(http.StatusOK, code)
+	_, ids = get("/users?deleted=only", token)
+	as.Empty(ids)
+
+	// Only deleted users can be restored.
+	as.Equal(http.StatusNotFound, restore())
+
+	// Restoring and listing deleted users takes users:delete.
+	_, viewerToken := as.newUserWithLevel("viewer@mail.com", 2)
+	code, _ = get("/users?deleted=only", viewerToken)
+	as.Equal(http.StatusForbidden, code)
+}
+
 func (as *ActionSuite) Test_Users_Delete_Own_Account() {
 	token, err := Login(as)
 	if err != nil {
@@ -188,3 +351,248 @@ func (as *ActionSuite) Test_Users_Delete_Own_Account() {
 
 	as.Equal(1, count)
 }
+
+func (as *ActionSuite) Test_Users_Index_Filter_Sort_Search() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	for _, u := range []struct {
+		name  string
+		email string
+		level int
+	}{{"alice", "alice@mail.com", 1}, {"bob", "bob@example.com", 2}, {"carol", "carol@example.com", 3}} {
+		user := &models.User{Name: u.name, Email: u.email, Password: "password", AccessLevel: nulls.NewInt(u.level)}
+		as.NoError(as.DB.Create(user))
+		as.NoError(models.AddMember(as.DB, Organization.ID, user))
+	}
+
+	index := func(query string) (int, []string, map[string]interface{}) {
+		req := as.JSON("/users?%s", query)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := req.Get()
+
+		var body struct {
+			Data []models.User          `json:"data"`
+			Meta map[string]interface{} `json:"meta"`
+		}
+		as.NoError(json.Unmarshal(res.Body.Bytes(), &body))
+		names := []string{}
+		for _, u := range body.Data {
+			names = append(names, u.Name)
+		}
+		return res.Result().StatusCode, names, body.Meta
+	}
+
+	code, names, _ := index("filter[access_level][gte]=2&sort=-name")
+	as.Equal(http.StatusOK, code)
+	as.Equal([]string{"carol", "bob", "admin"}, names)
+
+	_, names, _ = index("q=example&sort=name")
+	as.Equal([]string{"bob", "carol"}, names)
+	_, names, _ = index("q=EXAMPLE&sort=name")
+	as.Equal([]string{"bob", "carol"}, names)
+
+	_, names, _ = index("filter[email]=alice@mail.com")
+	as.Equal([]string{"alice"}, names)
+
+	_, names, meta := index("sort=name&per_page=2&page=2")
+	as.Equal([]string{"bob", "carol"}, names)
+	as.EqualValues(4, meta["total_entries_size"])
+
+	code, _, _ = index("filter[password]=x")
+	as.Equal(http.StatusUnprocessableEntity, code)
+
+	code, _, _ = index("sort=password")
+	as.Equal(http.StatusUnprocessableEntity, code)
+}
+
+func (as *ActionSuite) Test_Users_Index_Cursor() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	// Created within the same second, so the id has to break ties.
+	for i := 1; i <= 5; i++ {
+		user := &models.User{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@mail.com", i), Password: "password"}
+		as.NoError(as.DB.Create(user))
+		as.NoError(models.AddMember(as.DB, Organization.ID, user))
+	}
+
+	type page struct {
+		Data []models.User `json:"data"`
+		Meta cursorMeta    `json:"meta"`
+	}
+	index := func(query string) (int, page) {
+		req := as.JSON("/users?%s", query)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := req.Get()
+
+		p := page{}
+		as.NoError(json.Unmarshal(res.Body.Bytes(), &p))
+		return res.Result().StatusCode, p
+	}
+	names := func(p page) []string {
+		n := []string{}
+		for _, u := range p.Data {
+			n = append(n, u.Name)
+		}
+		return n
+	}
+
+	code, p := index("cursor=&per_page=2")
+	as.Equal(http.StatusOK, code)
+	as.Equal([]string{"admin", "user1"}, names(p))
+	as.Nil(p.Meta.PrevCursor)
+	as.NotNil(p.Meta.NextCursor)
+
+	_, p = index("per_page=2&cursor=" + *p.Meta.NextCursor)
+	as.Equal([]string{"user2", "user3"}, names(p))
+
+	_, p = index("per_page=2&cursor=" + *p.Meta.NextCursor)
+	as.Equal([]string{"user4", "user5"}, names(p))
+	as.Nil(p.Meta.NextCursor)
+
+	_, p = index("per_page=2&cursor=" + *p.Meta.PrevCursor)
+	as.Equal([]string{"user2", "user3"}, names(p))
+	as.NotNil(p.Meta.NextCursor)
+
+	_, p = index("per_page=2&cursor=" + *p.Meta.PrevCursor)
+	as.Equal([]string{"admin", "user1"}, names(p))
+	as.Nil(p.Meta.PrevCursor)
+
+	_, p = index("cursor=&filter[email]=user3@mail.com")
+	as.Equal([]string{"user3"}, names(p))
+	as.Nil(p.Meta.NextCursor)
+
+	code, _ = index("cursor=forged.cursor")
+	as.Equal(http.StatusUnprocessableEntity, code)
+
+	code, _ = index("cursor=&sort=name")
+	as.Equal(http.StatusUnprocessableEntity, code)
+}
+
+func (as *ActionSuite) Test_Users_Fields_Include() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+	other, otherAdmin := as.newOtherOrganization()
+	as.NoError(models.AddMember(as.DB, Organization.ID, otherAdmin))
+
+	get := func(path string) (int, map[string]interface{}) {
+		req := as.JSON(path)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := req.Get()
+
+		body := map[string]interface{}{}
+		as.NoError(json.Unmarshal(res.Body.Bytes(), &body))
+		return res.Result().StatusCode, body
+	}
+
+	code, body := get("/users?fields=name&sort=id")
+	as.Equal(http.StatusOK, code)
+	first := body["data"].([]interface{})[0].(map[string]interface{})
+	as.Equal(map[string]interface{}{"id": float64(UserAdmin.ID), "name": "admin"}, first)
+
+	code, body = get(fmt.Sprintf("/users/%d?fields=email&include=roles,organizations", otherAdmin.ID))
+	as.Equal(http.StatusOK, code)
+	data := body["data"].(map[string]interface{})
+	as.Equal("other@mail.com", data["email"])
+	as.NotContains(data, "name")
+
+	roles := data["roles"].([]interface{})
+	as.Len(roles, 1)
+	as.Equal("admin", roles[0].(map[string]interface{})["name"])
+
+	// The other organization is not one the admin belongs to.
+	orgs := data["organizations"].([]interface{})
+	as.Len(orgs, 1)
+	as.Equal(float64(Organization.ID), orgs[0].(map[string]interface{})["id"])
+	as.NotEqual(float64(other.ID), orgs[0].(map[string]interface{})["id"])
+
+	code, body = get("/users?cursor=&include=roles")
+	as.Equal(http.StatusOK, code)
+	for _, u := range body["data"].([]interface{}) {
+		as.Contains(u, "roles")
+		as.Contains(u, "email")
+	}
+
+	for _, path := range []string{"/users?fields=password", "/users?include=api_keys", fmt.Sprintf("/users/%d?fields=totp_secret", UserAdmin.ID)} {
+		code, body = get(path)
+		as.Equal(http.StatusUnprocessableEntity, code, path)
+		as.Equal("error", body["status"])
+	}
+}
+
+func (as *ActionSuite) Test_Users_ETag() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	user := &models.User{Name: "user", Email: "email@mail.com", Password: "password", AccessLevel: nulls.NewInt(1)}
+	as.NoError(as.DB.Create(user))
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
+
+	request := func(path string, headers map[string]string) *httptest.JSON {
+		req := as.JSON(path)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		for k, v := range headers {
+			req.Headers[k] = v
+		}
+		return req
+	}
+	path := fmt.Sprintf("/users/%d", user.ID)
+
+	res := request(path, nil).Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	tag := res.Header().Get("ETag")
+	as.NotEmpty(tag)
+
+	res = request(path, map[string]string{"If-None-Match": tag}).Get()
+	as.Equal(http.StatusNotModified, res.Result().StatusCode)
+	as.Empty(res.Body.String())
+
+	list := request("/users", nil).Get()
+	listTag := list.Header().Get("ETag")
+	as.NotEmpty(listTag)
+	res = request("/users", map[string]string{"If-None-Match": listTag}).Get()
+	as.Equal(http.StatusNotModified, res.Result().StatusCode)
+
+	res = request(path, map[string]string{"If-Match": `"stale"`}).Put(map[string]string{"name": "lost", "email": user.Email})
+	as.Equal(http.StatusPreconditionFailed, res.Result().StatusCode)
+
+	// If-Match compares strongly, If-None-Match weakly.
+	res = request(path, map[string]string{"If-Match": "W/" + tag}).Put(map[string]string{"name": "lost", "email": user.Email})
+	as.Equal(http.StatusPreconditionFailed, res.Result().StatusCode)
+	res = request(path, map[string]string{"If-None-Match": "W/" + tag}).Get()
+	as.Equal(http.StatusNotModified, res.Result().StatusCode)
+
+	res = request(path, map[string]string{"If-Match": tag}).Put(map[string]string{"name": "renamed", "email": user.Email})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	newTag := res.Header().Get("ETag")
+	as.NotEqual(tag, newTag)
+
+	// The old version is gone, so the lists and records are refetched.
+	res = request("/users", map[string]string{"If-None-Match": listTag}).Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	res = request(path, map[string]string{"If-None-Match": tag}).Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+	as.Equal(newTag, res.Header().Get("ETag"))
+
+	patch := request(path, map[string]string{"If-Match": tag, "Content-Type": "application/merge-patch+json"})
+	as.Equal(http.StatusPreconditionFailed, patch.Patch(map[string]string{"name": "lost"}).Result().StatusCode)
+
+	res = request(path, map[string]string{"If-Match": tag}).Delete()
+	as.Equal(http.StatusPreconditionFailed, res.Result().StatusCode)
+
+	// A sparse fetch carries the tag of the whole record.
+	res = request(path+"?fields=name", nil).Get()
+	as.Equal(newTag, res.Header().Get("ETag"))
+
+	res = request(path, map[string]string{"If-Match": newTag}).Delete()
+	as.Equal(http.StatusNoContent, res.Result().StatusCode)
+}
@@ -0,0 +1,282 @@
+package actions
+
+import (
+	"bufio"
+	"coke/internal/policy"
+	"coke/models"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/nulls"
+)
+
+// ExportBatchSize is how many users an export loads from the database at
+// a time.
+var ExportBatchSize = 500
+
+// ImportMaxRows caps the number of users in one import.
+var ImportMaxRows = 5000
+
+// userExportColumns are the CSV columns of an export, in order.
+var userExportColumns = []string{"id", "name", "email", "access_level", "verified_at", "created_at", "updated_at"}
+
+// userImportColumns are the CSV columns an import reads, in the order the
+// header row gives them.
+var userImportColumns = []string{"name", "email", "password", "password_confirmation", "access_level"}
+
+var errImportFormat = errors.New("format must be csv or ndjson")
+
+// Export streams every user matching the Index filters and search as CSV
+// or NDJSON, ordered by id.
+func (u UserResource) Export(c buffalo.Context) error {
+	if err := authorize(c, policy.ReadUser, nil); err != nil {
+		return forbidden(c, err)
+	}
+
+	format := c.Param("format")
+	list, verr := userListing.Parse(c.Request().URL.Query())
+	if format != "csv" && format != "ndjson" {
+		verr.Add("format", "Format must be csv or ndjson")
+	}
+	if c.Param("sort") != "" {
+		verr.Add("sort", "Exports are always ordered by id")
+	}
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	res := c.Response()
+	if format == "csv" {
+		res.Header().Set("Content-Type", "text/csv")
+	} else {
+		res.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	res.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	res.WriteHeader(http.StatusOK)
+
+	var write func(user models.User) error
+	csvw := csv.NewWriter(res)
+	if format == "csv" {
+		if err := csvw.Write(userExportColumns); err != nil {
+			return err
+		}
+		write = func(user models.User) error {
+			return csvw.Write(userCSVRecord(user))
+		}
+	} else {
+		enc := json.NewEncoder(res)
+		write = func(user models.User) error {
+			return enc.Encode(user)
+		}
+	}
+
+	// Batches keep memory flat however many users match.
+	last := 0
+	for {
+		users := models.Users{}
+		err := models.DB.Scope(scopeUsers(c)).Scope(list.Filters()).
+			Where("users.id > ?", last).Order("users.id asc").Limit(ExportBatchSize).All(&users)
+		if err != nil {
+			// The status line is gone, all that is left is to cut the stream.
+			c.Logger().Errorf("failed exporting users: %v", err)
+			return nil
+		}
+
+		for _, user := range users {
+			if err := write(user); err != nil {
+				return nil
+			}
+		}
+		csvw.Flush()
+		if f, ok := res.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		if len(users) < ExportBatchSize {
+			return nil
+		}
+		last = users[len(users)-1].ID
+	}
+}
+
+func userCSVRecord(user models.User) []string {
+	level := ""
+	if user.AccessLevel.Valid {
+		level = strconv.Itoa(user.AccessLevel.Int)
+	}
+	verified := ""
+	if user.VerifiedAt.Valid {
+		verified = user.VerifiedAt.Time.UTC().Format(time.RFC3339)
+	}
+
+	return []string{
+		strconv.Itoa(user.ID),
+		csvText(user.Name),
+		csvText(user.Email),
+		level,
+		verified,
+		user.CreatedAt.UTC().Format(time.RFC3339),
+		user.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+}
+
+// csvText keeps a user supplied value from being read as a formula when
+// the export is opened in a spreadsheet.
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+
+	return value
+}
+
+// Import creates users from a CSV or NDJSON body. Each row goes through
+// the Store rules; the report lists every row by its index, starting at 0
+// for the first row after the CSV header. With dry_run=true nothing is
+// saved.
+func (u UserResource) Import(c buffalo.Context) error {
+	mode := c.Param("mode")
+	if mode == "" {
+		mode = BulkAtomic
+	}
+	if mode != BulkAtomic && mode != BulkBestEffort {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"mode": {fmt.Sprintf("Mode must be %s or %s", BulkAtomic, BulkBestEffort)}},
+			Status: "error",
+		}))
+	}
+
+	rows, err := readUserImport(c.Param("format"), c.Request().Body)
+	if err != nil {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"file": {err.Error()}},
+			Status: "error",
+		}))
+	}
+
+	operations := map[string][]bulkOperation{}
+	for i := range rows {
+		operations["create"] = append(operations["create"], bulkCreate(c, &rows[i]))
+	}
+
+	dryRun := c.Param("dry_run") == "true"
+	results, meta, err := runBulk(mode, dryRun, []string{"create"}, operations)
+	if errors.Is(err, errBulkRolledBack) {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Data:   results["create"],
+			Errors: "No users were imported because some rows failed",
+			Status: "error",
+			Meta:   meta,
+		}))
+	}
+	if err != nil {
+		return err
+	}
+
+	return c.Render(http.StatusOK, r.JSON(Response{
+		Data:   results["create"],
+		Status: "ok",
+		Meta:   meta,
+	}))
+}
+
+// readUserImport parses an import body. Errors describe what is wrong
+// with the file and are safe to show.
+func readUserImport(format string, body io.Reader) ([]userJson, error) {
+	rows := []userJson{}
+	add := func(row userJson) error {
+		if len(rows) == ImportMaxRows {
+			return fmt.Errorf("at most %d rows can be imported at once", ImportMaxRows)
+		}
+		rows = append(rows, row)
+		return nil
+	}
+
+	switch format {
+	case "csv":
+		reader := csv.NewReader(body)
+		header, err := reader.Read()
+		if err == io.EOF {
+			return nil, errors.New("the file is empty")
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		columns := map[string]int{}
+		for i, name := range header {
+			columns[strings.TrimSpace(strings.ToLower(name))] = i
+		}
+		for _, name := range userImportColumns {
+			if _, ok := columns[name]; !ok {
+				return nil, fmt.Errorf("the %s column is missing", name)
+			}
+		}
+
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			field := func(name string) string {
+				if i := columns[name]; i < len(record) {
+					return strings.TrimSpace(record[i])
+				}
+				return ""
+			}
+			row := userJson{
+				Name:                 field("name"),
+				Email:                field("email"),
+				Password:             field("password"),
+				PasswordConfirmation: field("password_confirmation"),
+			}
+			if level, err := strconv.Atoi(field("access_level")); err == nil {
+				row.AccessLevel = nulls.NewInt(level)
+			}
+			if err := add(row); err != nil {
+				return nil, err
+			}
+		}
+	case "ndjson":
+		scanner := bufio.NewScanner(body)
+		for line := 1; scanner.Scan(); line++ {
+			if strings.TrimSpace(scanner.Text()) == "" {
+				continue
+			}
+			row := userJson{}
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				return nil, fmt.Errorf("line %d is not a JSON object", line)
+			}
+			if err := add(row); err != nil {
+				return nil, err
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errImportFormat
+	}
+
+	if len(rows) == 0 {
+		return nil, errors.New("the file has no rows")
+	}
+
+	return rows, nil
+}
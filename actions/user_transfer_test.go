@@ -0,0 +1,142 @@
+package actions
+
+import (
+	"coke/models"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gobuffalo/nulls"
+)
+
+func (as *ActionSuite) Test_Users_Export() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	for i := 1; i <= 4; i++ {
+		user := &models.User{Name: fmt.Sprintf("user%d", i), Email: fmt.Sprintf("user%d@example.com", i), Password: "password", AccessLevel: nulls.NewInt(1)}
+		as.NoError(as.DB.Create(user))
+		as.NoError(models.AddMember(as.DB, Organization.ID, user))
+	}
+
+	batch := ExportBatchSize
+	ExportBatchSize = 2
+	defer func() { ExportBatchSize = batch }()
+
+	export := func(query string) (int, string) {
+		req := as.JSON("/users/export?%s", query)
+		req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := req.Get()
+		return res.Result().StatusCode, res.Body.String()
+	}
+
+	code, body := export("format=csv&q=example")
+	as.Equal(http.StatusOK, code)
+	records, err := csv.NewReader(strings.NewReader(body)).ReadAll()
+	as.NoError(err)
+	as.Len(records, 5)
+	as.Equal(userExportColumns, records[0])
+	as.Equal("user1@example.com", records[1][2])
+	as.Equal("user4@example.com", records[4][2])
+
+	code, body = export("format=ndjson&filter[access_level][gte]=4")
+	as.Equal(http.StatusOK, code)
+	lines := strings.Split(strings.TrimSpace(body), "\n")
+	as.Len(lines, 1)
+	user := models.User{}
+	as.NoError(json.Unmarshal([]byte(lines[0]), &user))
+	as.Equal(UserAdmin.ID, user.ID)
+
+	code, _ = export("format=xlsx")
+	as.Equal(http.StatusUnprocessableEntity, code)
+	code, _ = export("format=csv&sort=name")
+	as.Equal(http.StatusUnprocessableEntity, code)
+}
+
+func (as *ActionSuite) Test_Users_Export_Formulas() {
+	token, err := Login(as)
+	as.NoError(err)
+
+	user := &models.User{Name: "=HYPERLINK(\"http://evil.test\")", Email: "@sum@example.com", Password: "password", AccessLevel: nulls.NewInt(1)}
+	as.NoError(as.DB.Create(user))
+	as.NoError(models.AddMember(as.DB, Organization.ID, user))
+
+	req := as.JSON("/users/export?format=csv&q=example")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Get()
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	records, err := csv.NewReader(strings.NewReader(res.Body.String())).ReadAll()
+	as.NoError(err)
+	as.Len(records, 2)
+	as.Equal("'=HYPERLINK(\"http://evil.test\")", records[1][1])
+	as.Equal("'@sum@example.com", records[1][2])
+
+	for _, value := range []string{"+1", "-1", "\tx", "\rx"} {
+		as.Equal("'"+value, csvText(value))
+	}
+	as.Equal("user", csvText("user"))
+	as.Equal("", csvText(""))
+}
+
+func (as *ActionSuite) Test_Users_Import() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	type report struct {
+		Data []bulkResult `json:"data"`
+		Meta bulkMeta     `json:"meta"`
+	}
+	upload := func(query, body string) (int, report) {
+		req, err := http.NewRequest(http.MethodPost, "/users/import?"+query, strings.NewReader(body))
+		as.NoError(err)
+		j := as.JSON("/users/import")
+		j.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+		res := j.Perform(req)
+
+		response := report{}
+		as.NoError(json.Unmarshal(res.Body.Bytes(), &response))
+		return res.Result().StatusCode, response
+	}
+	count := func() int {
+		n, err := as.DB.Count(&models.User{})
+		as.NoError(err)
+		return n
+	}
+
+	file := "Name,Email,Password,Password_Confirmation,Access_Level\n" +
+		"alice,alice@mail.com,secret,secret,1\n" +
+		"bob,not-an-email,secret,secret,1\n" +
+		"carol,carol@mail.com,secret,other,2\n"
+
+	code, res := upload("format=csv&dry_run=true", file)
+	as.Equal(http.StatusOK, code)
+	as.Equal(bulkMeta{Mode: BulkAtomic, DryRun: true, Succeeded: 1, Failed: 2}, res.Meta)
+	as.Contains(res.Data[1].Errors, "email")
+	as.Contains(res.Data[2].Errors, "password")
+	as.Equal(1, count())
+
+	code, res = upload("format=csv", file)
+	as.Equal(http.StatusUnprocessableEntity, code)
+	as.Equal("rolled_back", res.Data[0].Status)
+	as.Equal(1, count())
+
+	code, res = upload("format=csv&mode=best_effort", file)
+	as.Equal(http.StatusOK, code)
+	as.Equal(1, res.Meta.Succeeded)
+	as.Equal(2, count())
+
+	code, res = upload("format=ndjson", `{"name":"dave","email":"dave@mail.com","password":"secret","password_confirmation":"secret","access_level":1}`+"\n")
+	as.Equal(http.StatusOK, code)
+	as.Equal(1, res.Meta.Succeeded)
+	as.Equal(3, count())
+
+	code, _ = upload("format=csv", "name,email\nerin,erin@mail.com\n")
+	as.Equal(http.StatusUnprocessableEntity, code)
+}
@@ -1,49 +1,241 @@
 package actions
 
 import (
+	"coke/internal/cursor"
+	"coke/internal/listing"
+	"coke/internal/policy"
 	"coke/internal/rules"
+	"coke/internal/sparse"
 	"coke/models"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"reflect"
 
+	jsonpatch "github.com/evanphx/json-patch/v5"
 	"github.com/gobuffalo/buffalo"
 	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
 	"github.com/gobuffalo/validate"
 	"github.com/gobuffalo/validate/validators"
 )
 
 type UserResource struct{}
 
+// userListing whitelists the filters, sorts and search columns accepted by
+// UserResource.Index.
+var userListing = listing.Spec{
+	Filters: map[string]listing.Field{
+		"email":        {Column: "users.email", Kind: listing.String},
+		"name":         {Column: "users.name", Kind: listing.String},
+		"access_level": {Column: "users.access_level", Kind: listing.Int},
+		"status":       {Kind: listing.String, Clause: statusClause},
+		"created_at":   {Column: "users.created_at", Kind: listing.Time},
+	},
+	Sorts: map[string]string{
+		"id":           "users.id",
+		"name":         "users.name",
+		"email":        "users.email",
+		"access_level": "users.access_level",
+		"created_at":   "users.created_at",
+	},
+	Search:      []string{"users.name", "users.email"},
+	DefaultSort: "id",
+}
+
+// userFields whitelists what ?fields= and ?include= may ask for on users.
+var userFields = sparse.Spec{
+	Fields: []string{
+		"id", "name", "email", "access_level", "two_factor_enabled_at",
+		"verified_at", "pending_email", "status", "status_reason", "status_until",
+		"created_at", "updated_at",
+	},
+	Includes: []string{"roles", "organizations"},
+}
+
+// presentUsers shapes users as the selection asks. The default
+// representation is returned untouched.
+func presentUsers(c buffalo.Context, sel *sparse.Selection, users models.Users) (interface{}, error) {
+	if sel.Empty() {
+		return users, nil
+	}
+
+	ids := make([]int, len(users))
+	for i, user := range users {
+		ids[i] = user.ID
+	}
+
+	included := map[string]func(int) interface{}{}
+	for _, include := range sel.Includes {
+		switch include {
+		case "roles":
+			roles, err := models.RolesForUsers(models.DB, currentOrganization(c), ids)
+			if err != nil {
+				return nil, err
+			}
+			included[include] = func(id int) interface{} {
+				if roles[id] == nil {
+					return models.Roles{}
+				}
+				return roles[id]
+			}
+		case "organizations":
+			auth := c.Value("auth").(*models.User)
+			orgs, err := models.SharedOrganizations(models.DB, auth.ID, ids)
+			if err != nil {
+				return nil, err
+			}
+			included[include] = func(id int) interface{} {
+				if orgs[id] == nil {
+					return models.Organizations{}
+				}
+				return orgs[id]
+			}
+		}
+	}
+
+	out := make([]map[string]interface{}, len(users))
+	for i, user := range users {
+		m, err := sel.Project(user)
+		if err != nil {
+			return nil, err
+		}
+		for include, load := range included {
+			m[include] = load(user.ID)
+		}
+		out[i] = m
+	}
+
+	return out, nil
+}
+
 // UserIndex default implementation.
 func (u UserResource) Index(c buffalo.Context) error {
+	if err := authorize(c, policy.ReadUser, nil); err != nil {
+		return forbidden(c, err)
+	}
+
+	list, verr := userListing.Parse(c.Request().URL.Query())
+	sel, serr := userFields.Parse(c.Request().URL.Query())
+	verr.Append(serr)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	scope := scopeUsers(c)
+	switch c.Param("deleted") {
+	case "":
+	case "only":
+		if err := authorize(c, policy.DeleteUser, nil); err != nil {
+			return forbidden(c, err)
+		}
+		all := scopeAllUsers(c)
+		scope = func(q *pop.Query) *pop.Query {
+			return models.OnlyDeleted(all(q))
+		}
+	default:
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"deleted": {"Deleted must be only"}},
+			Status: "error",
+		}))
+	}
+
 	users := &models.Users{}
-	query := models.DB.PaginateFromParams(c.Params())
+	if usesCursor(c) {
+		if c.Param("sort") != "" {
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+				Errors: map[string][]string{"sort": {"Cursor pagination is always ordered by created_at"}},
+				Status: "error",
+			}))
+		}
+
+		meta, err := paginateUsersByCursor(c, models.DB.Scope(scope).Scope(list.Filters()), users)
+		if errors.Is(err, cursor.ErrInvalid) {
+			return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+				Errors: map[string][]string{"cursor": {"Cursor is invalid"}},
+				Status: "error",
+			}))
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := presentUsers(c, sel, *users)
+		if err != nil {
+			return err
+		}
+
+		response := Response{
+			Data:   data,
+			Status: "ok",
+			Meta:   meta,
+		}
+		return renderWithETag(c, response, response)
+	}
+
+	query := models.DB.Scope(scope).Scope(list.Scope()).PaginateFromParams(c.Params())
 	err := query.All(users)
 	if err != nil {
 		return err
 	}
 
+	data, err := presentUsers(c, sel, *users)
+	if err != nil {
+		return err
+	}
+
 	response := Response{
-		Data:   users,
+		Data:   data,
 		Status: "ok",
 		Meta:   query.Paginator,
 	}
-	return c.Render(http.StatusOK, r.JSON(response))
+	return renderWithETag(c, response, response)
 }
 
 func (u UserResource) Show(c buffalo.Context) error {
 	userId := c.Param("user_id")
 	user := models.User{}
-	err := models.DB.Find(&user, userId)
+	err := models.DB.Scope(scopeUsers(c)).Find(&user, userId)
 	if err != nil {
 		return err
 	}
 
+	if err := authorize(c, policy.ReadUser, &user); err != nil {
+		return forbidden(c, err)
+	}
+
+	sel, verr := userFields.Parse(c.Request().URL.Query())
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	var data interface{} = user
+	if !sel.Empty() {
+		shaped, err := presentUsers(c, sel, models.Users{user})
+		if err != nil {
+			return err
+		}
+		data = shaped.([]map[string]interface{})[0]
+	}
+
 	response := Response{
-		Data:   user,
+		Data:   data,
 		Status: "ok",
 	}
-	return c.Render(http.StatusOK, r.JSON(response))
+	// The tag names the record's version, not the representation, so a
+	// sparse fetch can still be used for If-Match.
+	return renderWithETag(c, user, response)
 }
 
 type userJson struct {
@@ -54,92 +246,294 @@ type userJson struct {
 	AccessLevel          nulls.Int `json:"access_level"`
 }
 
-func (u UserResource) Store(c buffalo.Context) error {
-	userJson := &userJson{}
-	if err := c.Bind(userJson); err != nil {
-		return err
-	}
+// validators returns the rules every new account has to pass, however it
+// is created. The email uniqueness check runs on tx.
+func (j *userJson) validators(tx *pop.Connection) []validate.Validator {
+	return []validate.Validator{
+		&validators.StringIsPresent{Field: j.Name, Name: "name"},
+		&validators.StringLengthInRange{Name: "name", Field: j.Name, Min: 3, Max: 100},
 
-	verr := validate.Validate(
-		&validators.StringIsPresent{Field: userJson.Name, Name: "name"},
-		&validators.StringLengthInRange{Name: "name", Field: userJson.Name, Min: 3, Max: 100},
+		&validators.EmailIsPresent{Field: j.Email, Name: "email"},
+		&rules.Unique{Name: "email", Field: j.Email, Model: &models.User{}, Tx: tx},
 
-		&validators.EmailIsPresent{Field: userJson.Email, Name: "email"},
-		&rules.Unique{Name: "email", Field: userJson.Email, Model: &models.User{}},
+		&validators.StringIsPresent{Field: j.Password, Name: "password"},
+		&validators.StringsMatch{Field: j.Password, Field2: j.PasswordConfirmation, Name: "password", Message: "Password and confirmation did not match."},
+	}
+}
 
-		&validators.IntIsPresent{Field: userJson.AccessLevel.Int, Name: "access_level"},
-		&validators.IntIsLessThan{Name: "access_level", Field: userJson.AccessLevel.Int, Compared: 5},
+// userError is a failed user operation the client has to fix, as opposed
+// to a server error.
+type userError struct {
+	status int
+	errors interface{}
+}
 
-		&validators.StringIsPresent{Field: userJson.Password, Name: "password"},
-		&validators.StringsMatch{Field: userJson.Password, Field2: userJson.PasswordConfirmation, Name: "password", Message: "Password and confirmation did not match."},
-	)
+func (e *userError) Error() string {
+	return http.StatusText(e.status)
+}
 
+func renderUserError(c buffalo.Context, err *userError) error {
+	response := Response{
+		Errors: err.errors,
+		Status: "error",
+	}
+	return c.Render(err.status, r.JSON(response))
+}
+
+// createUser validates and creates a user in the current organization.
+func createUser(c buffalo.Context, tx *pop.Connection, req *userJson) (*models.User, error) {
+	verr := validate.Validate(append(req.validators(tx),
+		&validators.IntIsPresent{Field: req.AccessLevel.Int, Name: "access_level"},
+		&validators.IntIsLessThan{Name: "access_level", Field: req.AccessLevel.Int, Compared: 5},
+	)...)
 	if verr.HasAny() {
-		response := Response{
-			Errors: verr.Errors,
-			Status: "error",
-		}
-		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+		return nil, &userError{http.StatusUnprocessableEntity, verr.Errors}
 	}
 
 	user := &models.User{
-		Name:                 userJson.Name,
-		Email:                userJson.Email,
-		Password:             userJson.Password,
-		PasswordConfirmation: userJson.PasswordConfirmation,
-		AccessLevel:          userJson.AccessLevel,
+		Name:                 req.Name,
+		Email:                req.Email,
+		Password:             req.Password,
+		PasswordConfirmation: req.PasswordConfirmation,
+		AccessLevel:          req.AccessLevel,
+	}
+	if err := authorize(c, policy.CreateUser, user); err != nil {
+		return nil, &userError{http.StatusForbidden, err.Error()}
+	}
+
+	if err := tx.Create(user); err != nil {
+		return nil, err
+	}
+	if org := currentOrganization(c); org != nil {
+		if err := models.AddMember(tx, org.ID, user); err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+func (u UserResource) Store(c buffalo.Context) error {
+	userJson := &userJson{}
+	if err := c.Bind(userJson); err != nil {
+		return err
+	}
+
+	var user *models.User
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		var err error
+		user, err = createUser(c, tx, userJson)
+		return err
+	})
+	var uerr *userError
+	if errors.As(err, &uerr) {
+		return renderUserError(c, uerr)
 	}
-	err := models.DB.Create(user)
 	if err != nil {
 		return err
 	}
 
+	err = requestEmailVerification(user, user.Email)
+	if err != nil {
+		c.Logger().Errorf("failed sending verification email: %v", err)
+	}
+
 	return c.Render(http.StatusCreated, r.JSON(user))
 }
 
 func (u UserResource) Update(c buffalo.Context) error {
 	user := models.User{}
-	err := models.DB.Find(&user, c.Param("user_id"))
+	err := models.DB.Scope(scopeUsers(c)).Find(&user, c.Param("user_id"))
 	if err != nil {
 		return err
 	}
 
+	if err := authorize(c, policy.UpdateUser, &user); err != nil {
+		return forbidden(c, err)
+	}
+
 	form := &models.User{}
 	if err := c.Bind(form); err != nil {
 		return err
 	}
 
-	verr := validate.Validate(
-		&validators.StringIsPresent{Field: form.Name, Name: "name"},
-		&validators.StringIsPresent{Field: form.Email, Name: "email"},
-		&validators.EmailIsPresent{Field: form.Email, Name: "email"},
-		&validators.StringLengthInRange{Name: "name", Field: form.Name, Min: 3, Max: 100},
-		&rules.Unique{Name: "email", Field: form.Email, Model: &models.User{}, Except: user.ID},
-	)
-	if verr.HasAny() {
-		response := Response{
-			Errors: verr.Errors,
+	return saveUserChanges(c, &user, form.Name, form.Email)
+}
+
+// userPatchable lists the fields of the user representation a PATCH may
+// change. Everything else must be left as it is.
+var userPatchable = map[string]bool{"name": true, "email": true}
+
+// Patch applies a JSON Merge Patch (RFC 7396) or JSON Patch (RFC 6902) to
+// the user's JSON representation.
+func (u UserResource) Patch(c buffalo.Context) error {
+	user := models.User{}
+	err := models.DB.Scope(scopeUsers(c)).Find(&user, c.Param("user_id"))
+	if err != nil {
+		return err
+	}
+
+	if err := authorize(c, policy.UpdateUser, &user); err != nil {
+		return forbidden(c, err)
+	}
+
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return err
+	}
+	doc, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get("Content-Type"))
+	var patched []byte
+	switch mediaType {
+	case "application/merge-patch+json":
+		patched, err = jsonpatch.MergePatch(doc, body)
+	case "application/json-patch+json":
+		var patch jsonpatch.Patch
+		patch, err = jsonpatch.DecodePatch(body)
+		if err == nil {
+			patched, err = patch.Apply(doc)
+		}
+	default:
+		return c.Error(http.StatusUnsupportedMediaType, errors.New("use application/merge-patch+json or application/json-patch+json"))
+	}
+	if errors.Is(err, jsonpatch.ErrTestFailed) {
+		return c.Render(http.StatusConflict, r.JSON(Response{
+			Errors: map[string][]string{"patch": {err.Error()}},
+			Status: "error",
+		}))
+	}
+	if err != nil {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"patch": {err.Error()}},
+			Status: "error",
+		}))
+	}
+
+	before, after := map[string]interface{}{}, map[string]interface{}{}
+	if err := json.Unmarshal(doc, &before); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(patched, &after); err != nil {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"patch": {"The patched document must be an object"}},
 			Status: "error",
+		}))
+	}
+
+	verr := map[string][]string{}
+	for key := range after {
+		if _, ok := before[key]; !ok {
+			verr[key] = append(verr[key], fmt.Sprintf("%s is not a user field", key))
 		}
-		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
 	}
+	for key, value := range before {
+		if !userPatchable[key] && !reflect.DeepEqual(value, after[key]) {
+			verr[key] = append(verr[key], fmt.Sprintf("%s can not be changed", key))
+		}
+	}
+	if len(verr) > 0 {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: verr,
+			Status: "error",
+		}))
+	}
+
+	name, _ := after["name"].(string)
+	email, _ := after["email"].(string)
+	return saveUserChanges(c, &user, name, email)
+}
 
-	form.ID = user.ID
-	err = models.DB.UpdateColumns(form, "name", "email")
+// saveUserChanges validates a new name and email for the user, writes
+// them and renders the result.
+func saveUserChanges(c buffalo.Context, user *models.User, name, email string) error {
+	var newEmail bool
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		if err := lockUserIfMatch(c, tx, user); err != nil {
+			return err
+		}
+
+		var err error
+		newEmail, err = changeUser(tx, user, name, email)
+		return err
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		return preconditionFailed(c)
+	}
+	var uerr *userError
+	if errors.As(err, &uerr) {
+		return renderUserError(c, uerr)
+	}
 	if err != nil {
 		return err
 	}
 
+	if newEmail {
+		err := requestEmailVerification(user, email)
+		if err != nil {
+			c.Logger().Errorf("failed sending verification email: %v", err)
+		}
+	}
+
+	tag, err := etag(user)
+	if err != nil {
+		return err
+	}
+	c.Response().Header().Set("ETag", tag)
+
 	response := Response{
-		Data:   form,
+		Data:   user,
 		Status: "ok",
 	}
 	return c.Render(http.StatusOK, r.JSON(response))
 }
 
+// changeUser validates a new name and email for the user and writes the
+// columns that changed. A new address only replaces the current one once
+// it is confirmed, so newEmail tells whether a verification is due.
+func changeUser(tx *pop.Connection, user *models.User, name, email string) (newEmail bool, err error) {
+	verr := validate.Validate(
+		&validators.StringIsPresent{Field: name, Name: "name"},
+		&validators.StringIsPresent{Field: email, Name: "email"},
+		&validators.EmailIsPresent{Field: email, Name: "email"},
+		&validators.StringLengthInRange{Name: "name", Field: name, Min: 3, Max: 100},
+		&rules.Unique{Name: "email", Field: email, Model: &models.User{}, Except: user.ID, Tx: tx},
+	)
+	if verr.HasAny() {
+		return false, &userError{http.StatusUnprocessableEntity, verr.Errors}
+	}
+
+	columns := []string{}
+	if name != user.Name {
+		user.Name = name
+		columns = append(columns, "name")
+	}
+	newEmail = email != user.Email
+	if newEmail {
+		user.PendingEmail = nulls.NewString(email)
+		columns = append(columns, "pending_email")
+	}
+
+	if len(columns) == 0 {
+		return false, nil
+	}
+
+	err = tx.UpdateColumns(user, columns...)
+	if err != nil {
+		return false, err
+	}
+
+	// Read back timestamps as the database stores them, so the record
+	// hashes to the same ETag as a later fetch.
+	return newEmail, tx.Reload(user)
+}
+
 func (u UserResource) Delete(c buffalo.Context) error {
 	user := &models.User{}
-	err := models.DB.Find(user, c.Param("user_id"))
+	err := models.DB.Scope(scopeUsers(c)).Find(user, c.Param("user_id"))
 	if err != nil {
 		return err
 	}
@@ -149,10 +543,92 @@ func (u UserResource) Delete(c buffalo.Context) error {
 		return c.Error(400, errors.New("can not delete your own account"))
 	}
 
-	err = models.DB.Destroy(user)
+	if err := authorize(c, policy.DeleteUser, user); err != nil {
+		return forbidden(c, err)
+	}
+
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		if err := lockUserIfMatch(c, tx, user); err != nil {
+			return err
+		}
+		if err := keepTopAdmin(tx, currentOrganization(c), user); err != nil {
+			return err
+		}
+		return removeUser(c, tx, user)
+	})
+	if errors.Is(err, errPreconditionFailed) {
+		return preconditionFailed(c)
+	}
+	if errors.Is(err, errLastAdmin) {
+		return lastAdmin(c)
+	}
 	if err != nil {
 		return err
 	}
 
 	return c.Render(http.StatusNoContent, r.JSON(nil))
 }
+
+// lockUserIfMatch checks the request's If-Match header against the user as
+// locked on tx, so that of two clients holding the same tag only the first
+// one to write succeeds. Without the header the user is left as loaded.
+func lockUserIfMatch(c buffalo.Context, tx *pop.Connection, user *models.User) error {
+	if c.Request().Header.Get("If-Match") == "" {
+		return nil
+	}
+
+	err := tx.RawQuery("SELECT * FROM users WHERE id = ? FOR UPDATE", user.ID).First(user)
+	if err != nil {
+		return err
+	}
+
+	ok, err := ifMatch(c, user)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errPreconditionFailed
+	}
+
+	return nil
+}
+
+// removeUser soft deletes the user. Someone who also belongs to other
+// organizations only leaves the current one.
+func removeUser(c buffalo.Context, tx *pop.Connection, user *models.User) error {
+	if org := currentOrganization(c); org != nil {
+		others, err := tx.Where("user_id = ? AND organization_id != ?", user.ID, org.ID).Count(&models.Membership{})
+		if err != nil {
+			return err
+		}
+		if others > 0 {
+			return tx.RawQuery("DELETE FROM memberships WHERE user_id = ? AND organization_id = ?", user.ID, org.ID).Exec()
+		}
+	}
+
+	return user.SoftDelete(tx)
+}
+
+// Restore brings back a soft deleted user.
+func (u UserResource) Restore(c buffalo.Context) error {
+	user := &models.User{}
+	err := models.DB.Scope(scopeAllUsers(c)).Scope(models.OnlyDeleted).Find(user, c.Param("user_id"))
+	if err != nil {
+		return err
+	}
+
+	if err := authorize(c, policy.DeleteUser, user); err != nil {
+		return forbidden(c, err)
+	}
+
+	err = user.Restore(models.DB)
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   user,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
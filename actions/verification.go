@@ -0,0 +1,170 @@
+package actions
+
+import (
+	"coke/internal/rules"
+	"coke/internal/token"
+	"coke/mailers"
+	"coke/models"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/gobuffalo/buffalo"
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate"
+	"github.com/gobuffalo/validate/validators"
+)
+
+// EmailVerificationLifetime is how long a confirmation link stays valid.
+var EmailVerificationLifetime = 24 * time.Hour
+
+// RequireVerifiedEmail makes AuthCreate refuse accounts whose email has
+// not been confirmed yet.
+var RequireVerifiedEmail = envy.Get("REQUIRE_VERIFIED_EMAIL", "false") == "true"
+
+var errVerificationTokenInvalid = errors.New("verification token invalid")
+
+type emailVerify struct {
+	Token string `json:"token"`
+}
+
+// AuthVerify confirms an email address. For an email change this is when
+// the pending address replaces the current one. Pending accounts become
+// active.
+func AuthVerify(c buffalo.Context) error {
+	req := &emailVerify{}
+	if err := c.Bind(req); err != nil {
+		return err
+	}
+	verr := validate.Validate(
+		&validators.StringIsPresent{Name: "token", Field: req.Token},
+	)
+	if verr.HasAny() {
+		response := Response{
+			Errors: verr.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+
+	user := &models.User{}
+	err := models.DB.Transaction(func(tx *pop.Connection) error {
+		verification := &models.EmailVerification{}
+		err := tx.Where("token_hash = ? AND used_at IS NULL AND expires_at > ?", token.Hash(req.Token), time.Now()).First(verification)
+		if err != nil {
+			return errVerificationTokenInvalid
+		}
+
+		err = tx.Find(user, verification.UserID)
+		if err != nil {
+			return err
+		}
+
+		verr := validate.Validate(
+			&rules.Unique{Name: "email", Field: verification.Email, Model: &models.User{}, Except: user.ID},
+		)
+		if verr.HasAny() {
+			return verr
+		}
+
+		verification.UsedAt = nulls.NewTime(time.Now())
+		err = tx.UpdateColumns(verification, "used_at")
+		if err != nil {
+			return err
+		}
+
+		user.Email = verification.Email
+		if user.PendingEmail.String == verification.Email {
+			user.PendingEmail = nulls.String{}
+		}
+		user.VerifiedAt = nulls.NewTime(time.Now())
+		err = tx.UpdateColumns(user, "email", "pending_email", "verified_at")
+		if err != nil || user.Status != models.StatusPending {
+			return err
+		}
+
+		return user.SetStatus(tx, models.StatusActive, "", nulls.Time{})
+	})
+
+	var verrs *validate.Errors
+	if errors.As(err, &verrs) {
+		response := Response{
+			Errors: verrs.Errors,
+			Status: "error",
+		}
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(response))
+	}
+	if errors.Is(err, errVerificationTokenInvalid) {
+		return c.Render(http.StatusUnprocessableEntity, r.JSON(Response{
+			Errors: map[string][]string{"token": {"Verification token is invalid or expired"}},
+			Status: "error",
+		}))
+	}
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   user,
+		Status: "ok",
+	}
+	return c.Render(http.StatusOK, r.JSON(response))
+}
+
+// AuthVerifyResend sends a new confirmation link for the pending address,
+// or for the current one when it was never confirmed.
+func AuthVerifyResend(c buffalo.Context) error {
+	auth := c.Value("auth").(*models.User)
+
+	email := auth.PendingEmail.String
+	if !auth.PendingEmail.Valid {
+		if auth.VerifiedAt.Valid {
+			return c.Error(http.StatusConflict, errors.New("email address is already verified"))
+		}
+		email = auth.Email
+	}
+
+	err := requestEmailVerification(auth, email)
+	if err != nil {
+		return err
+	}
+
+	response := Response{
+		Data:   "A confirmation link has been sent",
+		Status: "ok",
+	}
+	return c.Render(http.StatusAccepted, r.JSON(response))
+}
+
+// requestEmailVerification replaces any outstanding confirmation link of the
+// user with a new one for email and sends it.
+func requestEmailVerification(user *models.User, email string) error {
+	verificationToken, err := token.Generate(32)
+	if err != nil {
+		return err
+	}
+
+	err = models.DB.Transaction(func(tx *pop.Connection) error {
+		err := tx.RawQuery(
+			"UPDATE email_verifications SET used_at = ? WHERE user_id = ? AND used_at IS NULL",
+			time.Now(), user.ID,
+		).Exec()
+		if err != nil {
+			return err
+		}
+
+		return tx.Create(&models.EmailVerification{
+			UserID:    user.ID,
+			Email:     email,
+			TokenHash: token.Hash(verificationToken),
+			ExpiresAt: time.Now().Add(EmailVerificationLifetime),
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	return mailers.SendEmailVerification(user, email, verificationToken, EmailVerificationLifetime.String())
+}
@@ -0,0 +1,60 @@
+package actions
+
+import (
+	"coke/models"
+	"fmt"
+	"net/http"
+
+	"github.com/gobuffalo/nulls"
+)
+
+func (as *ActionSuite) Test_Auth_Verify_New_Account() {
+	token, err := Login(as)
+	if err != nil {
+		as.Fail("token generation failed")
+	}
+
+	req := as.JSON("/users")
+	req.Headers["Authorization"] = fmt.Sprintf("Bearer %s", token)
+	res := req.Post(userJson{
+		Name:                 "user",
+		Email:                "user@mail.com",
+		Password:             "password",
+		PasswordConfirmation: "password",
+		AccessLevel:          nulls.NewInt(1),
+	})
+	as.Equal(http.StatusCreated, res.Result().StatusCode)
+
+	messages, err := Outbox.Messages()
+	as.NoError(err)
+	as.Len(messages, 1)
+
+	match := linkTokenPattern.FindStringSubmatch(messages[0].Bodies[0].Content)
+	if match == nil {
+		as.FailNow("verification link not found in email")
+	}
+
+	res = as.JSON("/auth/verify").Post(&emailVerify{Token: match[1]})
+	as.Equal(http.StatusOK, res.Result().StatusCode)
+
+	res = as.JSON("/auth/verify").Post(&emailVerify{Token: match[1]})
+	as.Equal(http.StatusUnprocessableEntity, res.Result().StatusCode)
+
+	user := &models.User{}
+	err = as.DB.Where("email = ?", "user@mail.com").First(user)
+	as.NoError(err)
+	as.True(user.VerifiedAt.Valid)
+}
+
+func (as *ActionSuite) Test_Auth_Create_Requires_Verified_Email() {
+	RequireVerifiedEmail = true
+	defer func() { RequireVerifiedEmail = false }()
+
+	err := NewAdmin(as)
+	if err != nil {
+		as.T().Fatal("failed creating new User Admin")
+	}
+
+	res := as.JSON("/auth").Post(&credential{Email: UserAdmin.Email, Password: "password"})
+	as.Equal(http.StatusForbidden, res.Result().StatusCode)
+}
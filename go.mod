@@ -3,13 +3,15 @@ module coke
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.2.1
+	github.com/evanphx/json-patch/v5 v5.9.11
 	github.com/gobuffalo/buffalo v1.0.1
 	github.com/gobuffalo/envy v1.10.2
 	github.com/gobuffalo/grift v1.5.2
+	github.com/gobuffalo/httptest v1.5.2
 	github.com/gobuffalo/mw-contenttype v1.0.1
 	github.com/gobuffalo/mw-forcessl v1.0.1
 	github.com/gobuffalo/mw-paramlogger v1.0.1
-	github.com/gobuffalo/mw-tokenauth v1.0.1
 	github.com/gobuffalo/nulls v0.4.2
 	github.com/gobuffalo/pop/v6 v6.1.0
 	github.com/gobuffalo/suite/v4 v4.0.3
@@ -25,7 +27,6 @@ require (
 )
 
 require (
-	github.com/BurntSushi/toml v1.2.1 // indirect
 	github.com/Masterminds/semver/v3 v3.2.0 // indirect
 	github.com/aymerick/douceur v0.2.0 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
@@ -40,7 +41,6 @@ require (
 	github.com/gobuffalo/flect v0.3.0 // indirect
 	github.com/gobuffalo/github_flavored_markdown v1.1.3 // indirect
 	github.com/gobuffalo/helpers v0.6.7 // indirect
-	github.com/gobuffalo/httptest v1.5.2 // indirect
 	github.com/gobuffalo/logger v1.0.7 // indirect
 	github.com/gobuffalo/meta v0.3.3 // indirect
 	github.com/gobuffalo/mw-csrf v1.0.1 // indirect
@@ -86,7 +86,7 @@ require (
 	github.com/stretchr/testify v1.8.1 // indirect
 	golang.org/x/net v0.5.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
+	golang.org/x/sys v0.21.0 // indirect
 	golang.org/x/term v0.4.0 // indirect
 	golang.org/x/text v0.6.0 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
@@ -4,8 +4,10 @@ import (
 	"coke/internal/rules"
 	"coke/models"
 	"fmt"
+	"time"
 
 	"github.com/gobuffalo/grift/grift"
+	"github.com/gobuffalo/nulls"
 	"github.com/gobuffalo/validate"
 )
 
@@ -14,9 +16,11 @@ var _ = grift.Namespace("admin", func() {
 	grift.Desc("seed", "Seed superadmin")
 	grift.Add("seed", func(c *grift.Context) error {
 		user := &models.User{
-			Name:     "admin",
-			Email:    "admin@mail.com",
-			Password: "password",
+			Name:        "admin",
+			Email:       "admin@mail.com",
+			Password:    "password",
+			AccessLevel: nulls.NewInt(4),
+			VerifiedAt:  nulls.NewTime(time.Now()),
 		}
 
 		verr := validate.Validate(
@@ -1,6 +1,13 @@
 package grifts
 
 import (
+	"coke/actions"
+	"coke/models"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/envy"
 	"github.com/gobuffalo/grift/grift"
 )
 
@@ -8,7 +15,48 @@ var _ = grift.Namespace("db", func() {
 
 	grift.Desc("seed", "Seeds a database")
 	grift.Add("seed", func(c *grift.Context) error {
-		// Add DB seeding stuff here
+		return models.SeedRoles(models.DB)
+	})
+
+	grift.Desc("encrypt_totp_secrets", "Encrypts the TOTP secrets stored in the clear with TOTP_ENCRYPTION_KEY")
+	grift.Add("encrypt_totp_secrets", func(c *grift.Context) error {
+		// Without it the key is a throwaway one, and the secrets would be
+		// lost on exit.
+		if envy.Get("TOTP_ENCRYPTION_KEY", "") == "" {
+			return errors.New("TOTP_ENCRYPTION_KEY must be set")
+		}
+
+		n, err := models.EncryptTOTPSecrets(models.DB, actions.TOTPSecrets)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d TOTP secrets have been encrypted\n", n)
+
+		return nil
+	})
+
+	grift.Desc("purge_idempotency_keys", "Deletes stored responses whose Idempotency-Key has expired")
+	grift.Add("purge_idempotency_keys", func(c *grift.Context) error {
+		n, err := models.PurgeExpiredIdempotencyKeys(models.DB, time.Now())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d expired idempotency keys have been purged\n", n)
+
+		return nil
+	})
+
+	grift.Desc("purge_revoked_tokens", "Deletes denylisted tokens that have expired on their own")
+	grift.Add("purge_revoked_tokens", func(c *grift.Context) error {
+		n, err := models.PurgeExpiredRevokedTokens(models.DB, time.Now())
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d expired revoked tokens have been purged\n", n)
+
 		return nil
 	})
 
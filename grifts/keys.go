@@ -0,0 +1,32 @@
+package grifts
+
+import (
+	"coke/internal/keys"
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/grift/grift"
+)
+
+var _ = grift.Namespace("keys", func() {
+
+	grift.Desc("generate", "Generate a new JWT signing key (ed25519 or rsa)")
+	grift.Add("generate", func(c *grift.Context) error {
+		kind := "ed25519"
+		if len(c.Args) > 0 {
+			kind = c.Args[0]
+		}
+
+		kid := time.Now().UTC().Format("20060102150405")
+		path, err := keys.Generate(envy.Get("JWT_KEYS_DIR", "keys"), kid, kind)
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("Signing key %s has been written to %s\n", kid, path)
+
+		return nil
+	})
+
+})
@@ -0,0 +1,37 @@
+package grifts
+
+import (
+	"coke/models"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/gobuffalo/envy"
+	"github.com/gobuffalo/grift/grift"
+)
+
+var _ = grift.Namespace("users", func() {
+
+	grift.Desc("purge", "Permanently delete users soft deleted more than USER_RETENTION_DAYS (default 30) days ago")
+	grift.Add("purge", func(c *grift.Context) error {
+		days := envy.Get("USER_RETENTION_DAYS", "30")
+		if len(c.Args) > 0 {
+			days = c.Args[0]
+		}
+
+		retention, err := strconv.Atoi(days)
+		if err != nil || retention < 0 {
+			return fmt.Errorf("invalid retention period %q", days)
+		}
+
+		n, err := models.PurgeDeletedUsers(models.DB, time.Now().AddDate(0, 0, -retention))
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("%d deleted users have been purged\n", n)
+
+		return nil
+	})
+
+})
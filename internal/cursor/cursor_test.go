@@ -0,0 +1,40 @@
+package cursor
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Encode_Decode(t *testing.T) {
+	key := []byte("secret")
+	c := Cursor{CreatedAt: time.Date(2023, 4, 1, 10, 0, 0, 500, time.FixedZone("x", 3600)), ID: 42, Before: true}
+
+	decoded, err := Decode(key, Encode(key, c))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.CreatedAt.Equal(c.CreatedAt) || decoded.ID != 42 || !decoded.Before {
+		t.Fatalf("round trip mismatch: %+v", decoded)
+	}
+}
+
+func Test_Decode_Rejects(t *testing.T) {
+	key := []byte("secret")
+	valid := Encode(key, Cursor{CreatedAt: time.Now(), ID: 1})
+	p, sig, _ := strings.Cut(valid, ".")
+	forged := base64.RawURLEncoding.EncodeToString([]byte(`{"t":"2023-01-01T00:00:00Z","i":999}`))
+
+	for name, s := range map[string]string{
+		"empty":         "",
+		"no signature":  p,
+		"bad signature": p + ".AAAA",
+		"edited":        forged + "." + sig,
+		"other key":     Encode([]byte("other"), Cursor{ID: 1}),
+	} {
+		if _, err := Decode(key, s); err != ErrInvalid {
+			t.Errorf("%s: expected ErrInvalid, got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Package identity federates login to external identity providers.
+package identity
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+
+	"coke/internal/token"
+
+	"github.com/BurntSushi/toml"
+)
+
+// ErrInvalidIdentity is returned when a provider response cannot be
+// trusted, e.g. a bad signature, wrong audience or mismatched nonce.
+var ErrInvalidIdentity = errors.New("identity provider response is invalid")
+
+// Identity is what an external provider asserts about the signed in user.
+type Identity struct {
+	Provider      string
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+// Login holds the per-attempt secrets that must be remembered between
+// sending the user to the provider and handling the callback.
+type Login struct {
+	State    string
+	Nonce    string
+	Verifier string
+}
+
+// NewLogin generates a fresh state, nonce and PKCE verifier.
+func NewLogin() (Login, error) {
+	l := Login{}
+	for _, v := range []*string{&l.State, &l.Nonce, &l.Verifier} {
+		s, err := token.Generate(32)
+		if err != nil {
+			return Login{}, err
+		}
+		*v = s
+	}
+
+	return l, nil
+}
+
+// Challenge is the S256 PKCE code challenge for the login's verifier.
+func (l Login) Challenge() string {
+	sum := sha256.Sum256([]byte(l.Verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// Authenticator signs users in against an external identity provider
+// using a redirect based flow.
+type Authenticator interface {
+	// Name is the provider name used in routes and identity links.
+	Name() string
+	// AutoProvision reports whether unknown users may be created on
+	// their first login.
+	AutoProvision() bool
+	// AuthCodeURL is where the user is sent to sign in.
+	AuthCodeURL(ctx context.Context, l Login) (string, error)
+	// Exchange redeems the authorization code and returns the verified
+	// identity of the user.
+	Exchange(ctx context.Context, code string, l Login) (*Identity, error)
+}
+
+// Config is the layout of the identity providers file.
+type Config struct {
+	Providers []ProviderConfig `toml:"provider"`
+}
+
+// ProviderConfig describes a single provider. The client secret is never
+// stored in the file; ClientSecretEnv names the variable holding it.
+type ProviderConfig struct {
+	Name            string   `toml:"name"`
+	Type            string   `toml:"type"`
+	Issuer          string   `toml:"issuer"`
+	ClientID        string   `toml:"client_id"`
+	ClientSecretEnv string   `toml:"client_secret_env"`
+	RedirectURL     string   `toml:"redirect_url"`
+	Scopes          []string `toml:"scopes"`
+	AutoProvision   bool     `toml:"auto_provision"`
+}
+
+// Load reads the providers file at path. A missing file yields no
+// providers so that federation stays opt-in.
+func Load(path string) (map[string]Authenticator, error) {
+	providers := map[string]Authenticator{}
+
+	cfg := Config{}
+	_, err := toml.DecodeFile(path, &cfg)
+	if errors.Is(err, os.ErrNotExist) {
+		return providers, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pc := range cfg.Providers {
+		if pc.Name == "" {
+			return nil, errors.New("identity provider without a name")
+		}
+		if _, ok := providers[pc.Name]; ok {
+			return nil, fmt.Errorf("duplicate identity provider %q", pc.Name)
+		}
+
+		switch pc.Type {
+		case "oidc", "":
+			oc := OIDCConfig{
+				Name:          pc.Name,
+				Issuer:        pc.Issuer,
+				ClientID:      pc.ClientID,
+				RedirectURL:   pc.RedirectURL,
+				Scopes:        pc.Scopes,
+				AutoProvision: pc.AutoProvision,
+			}
+			if pc.ClientSecretEnv != "" {
+				oc.ClientSecret = os.Getenv(pc.ClientSecretEnv)
+			}
+			p, err := NewOIDC(oc)
+			if err != nil {
+				return nil, fmt.Errorf("identity provider %q: %w", pc.Name, err)
+			}
+			providers[pc.Name] = p
+		default:
+			return nil, fmt.Errorf("identity provider %q: unknown type %q", pc.Name, pc.Type)
+		}
+	}
+
+	return providers, nil
+}
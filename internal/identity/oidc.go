@@ -0,0 +1,316 @@
+package identity
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"coke/internal/keys"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// idTokenMethods are the signing algorithms accepted on ID tokens. HMAC
+// and "none" are deliberately absent.
+var idTokenMethods = []string{"RS256", "RS384", "RS512", "PS256", "ES256", "ES384", "EdDSA"}
+
+// OIDCConfig configures an OpenID Connect provider.
+type OIDCConfig struct {
+	Name          string
+	Issuer        string
+	ClientID      string
+	ClientSecret  string
+	RedirectURL   string
+	Scopes        []string
+	AutoProvision bool
+	// HTTPClient is used for discovery, JWKS and token requests.
+	// Defaults to a client with a 10 second timeout.
+	HTTPClient *http.Client
+}
+
+// OIDC authenticates users with the OpenID Connect authorization code
+// flow and PKCE. Endpoints are discovered from the issuer on first use.
+type OIDC struct {
+	cfg OIDCConfig
+
+	mu        sync.Mutex
+	discovery *discovery
+	jwks      map[string]crypto.PublicKey
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+type tokenResponse struct {
+	IDToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type idTokenClaims struct {
+	jwt.RegisteredClaims
+	Nonce         string `json:"nonce"`
+	AuthorizedBy  string `json:"azp"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+}
+
+// NewOIDC returns an OIDC provider. No network request is made until the
+// first login.
+func NewOIDC(cfg OIDCConfig) (*OIDC, error) {
+	if cfg.Issuer == "" || cfg.ClientID == "" || cfg.RedirectURL == "" {
+		return nil, errors.New("issuer, client_id and redirect_url are required")
+	}
+	if len(cfg.Scopes) == 0 {
+		cfg.Scopes = []string{"openid", "email", "profile"}
+	}
+	if cfg.HTTPClient == nil {
+		cfg.HTTPClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+
+	return &OIDC{cfg: cfg}, nil
+}
+
+// Name implements Authenticator.
+func (p *OIDC) Name() string {
+	return p.cfg.Name
+}
+
+// AutoProvision implements Authenticator.
+func (p *OIDC) AutoProvision() bool {
+	return p.cfg.AutoProvision
+}
+
+// AuthCodeURL implements Authenticator.
+func (p *OIDC) AuthCodeURL(ctx context.Context, l Login) (string, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(d.AuthorizationEndpoint)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.cfg.ClientID)
+	q.Set("redirect_uri", p.cfg.RedirectURL)
+	q.Set("scope", strings.Join(p.cfg.Scopes, " "))
+	q.Set("state", l.State)
+	q.Set("nonce", l.Nonce)
+	q.Set("code_challenge", l.Challenge())
+	q.Set("code_challenge_method", "S256")
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Exchange implements Authenticator.
+func (p *OIDC) Exchange(ctx context.Context, code string, l Login) (*Identity, error) {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.cfg.RedirectURL)
+	form.Set("client_id", p.cfg.ClientID)
+	form.Set("code_verifier", l.Verifier)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.cfg.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.cfg.ClientID), url.QueryEscape(p.cfg.ClientSecret))
+	}
+
+	res, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	tr := &tokenResponse{}
+	if err := json.NewDecoder(res.Body).Decode(tr); err != nil {
+		return nil, fmt.Errorf("%w: token response: %v", ErrInvalidIdentity, err)
+	}
+	if res.StatusCode != http.StatusOK || tr.Error != "" {
+		return nil, fmt.Errorf("%w: token endpoint: %s %s", ErrInvalidIdentity, tr.Error, tr.ErrorDescription)
+	}
+	if tr.IDToken == "" {
+		return nil, fmt.Errorf("%w: no id_token in response", ErrInvalidIdentity)
+	}
+
+	claims, err := p.verify(ctx, tr.IDToken, l.Nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Identity{
+		Provider:      p.cfg.Name,
+		Subject:       claims.Subject,
+		Email:         strings.ToLower(claims.Email),
+		EmailVerified: claims.EmailVerified,
+		Name:          claims.Name,
+	}, nil
+}
+
+// verify checks the ID token signature against the issuer's JWKS along
+// with the issuer, audience, expiry and nonce claims.
+func (p *OIDC) verify(ctx context.Context, raw, nonce string) (*idTokenClaims, error) {
+	parser := jwt.NewParser(jwt.WithValidMethods(idTokenMethods))
+	claims := &idTokenClaims{}
+	_, err := parser.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return p.publicKey(ctx, kid)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidIdentity, err)
+	}
+
+	if strings.TrimSuffix(claims.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIdentity, claims.Issuer)
+	}
+	if !claims.VerifyAudience(p.cfg.ClientID, true) {
+		return nil, fmt.Errorf("%w: unexpected audience", ErrInvalidIdentity)
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedBy != p.cfg.ClientID {
+		return nil, fmt.Errorf("%w: unexpected authorized party", ErrInvalidIdentity)
+	}
+	if claims.ExpiresAt == nil {
+		return nil, fmt.Errorf("%w: missing exp", ErrInvalidIdentity)
+	}
+	if claims.Nonce == "" || claims.Nonce != nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIdentity)
+	}
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("%w: missing sub", ErrInvalidIdentity)
+	}
+
+	return claims, nil
+}
+
+// publicKey looks the kid up in the cached JWKS, refetching it once when
+// the key is unknown so that provider key rotation is picked up.
+func (p *OIDC) publicKey(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	p.mu.Lock()
+	key, ok := p.jwks[kid]
+	p.mu.Unlock()
+	if ok {
+		return key, nil
+	}
+
+	if err := p.fetchJWKS(ctx); err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, ok := p.jwks[kid]; ok {
+		return key, nil
+	}
+	// A provider publishing a single key may omit kid from its tokens.
+	if kid == "" && len(p.jwks) == 1 {
+		for _, key := range p.jwks {
+			return key, nil
+		}
+	}
+
+	return nil, keys.ErrUnknownKey
+}
+
+func (p *OIDC) fetchJWKS(ctx context.Context) error {
+	d, err := p.discover(ctx)
+	if err != nil {
+		return err
+	}
+
+	set := keys.JWKS{}
+	if err := p.getJSON(ctx, d.JWKSURI, &set); err != nil {
+		return err
+	}
+
+	found := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			// Skip key types we cannot use rather than failing the set.
+			continue
+		}
+		found[jwk.Kid] = key
+	}
+
+	p.mu.Lock()
+	p.jwks = found
+	p.mu.Unlock()
+
+	return nil
+}
+
+func (p *OIDC) discover(ctx context.Context) (*discovery, error) {
+	p.mu.Lock()
+	d := p.discovery
+	p.mu.Unlock()
+	if d != nil {
+		return d, nil
+	}
+
+	d = &discovery{}
+	if err := p.getJSON(ctx, p.cfg.Issuer+"/.well-known/openid-configuration", d); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != p.cfg.Issuer {
+		return nil, fmt.Errorf("discovery issuer %q does not match %q", d.Issuer, p.cfg.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+
+	p.mu.Lock()
+	p.discovery = d
+	p.mu.Unlock()
+
+	return d, nil
+}
+
+func (p *OIDC) getJSON(ctx context.Context, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := p.cfg.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", u, res.Status)
+	}
+
+	return json.NewDecoder(res.Body).Decode(v)
+}
@@ -0,0 +1,343 @@
+package keys
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+var (
+	// ErrUnknownKey is returned when a token names a kid that is not loaded
+	// or has been retired.
+	ErrUnknownKey = errors.New("unknown signing key")
+	// ErrBadSigningMethod is returned when the token algorithm does not
+	// match the algorithm of the key it names.
+	ErrBadSigningMethod = errors.New("unexpected signing method")
+	// ErrNoSigner is returned when none of the loaded keys can sign.
+	ErrNoSigner = errors.New("no active private key to sign with")
+)
+
+// Key is a single signing or verification key identified by its kid.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+	Retired bool
+}
+
+// Set holds every key loaded from the key directory and the one currently
+// used to sign new tokens.
+type Set struct {
+	keys   map[string]*Key
+	signer *Key
+}
+
+// Load reads every *.pem file in dir. The file name without its extension
+// is used as the kid. Files may hold a PKCS#8/PKCS#1 private key or a PKIX
+// public key; public keys can only be used for verification.
+//
+// Keys listed in retired are kept out of verification and the JWKS. The
+// signing key is signingKID when set, otherwise the active private key with
+// the greatest kid, so naming keys by creation date rotates automatically.
+func Load(dir string, retired []string, signingKID string) (*Set, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Set{keys: map[string]*Key{}}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		k, err := parseKey(kid, data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		s.keys[kid] = k
+	}
+
+	for _, kid := range retired {
+		if k, ok := s.keys[strings.TrimSpace(kid)]; ok {
+			k.Retired = true
+		}
+	}
+
+	if signingKID != "" {
+		k, ok := s.keys[signingKID]
+		if !ok || k.Retired || k.Private == nil {
+			return nil, fmt.Errorf("signing key %q: %w", signingKID, ErrNoSigner)
+		}
+		s.signer = k
+		return s, nil
+	}
+
+	for _, kid := range s.kids() {
+		k := s.keys[kid]
+		if !k.Retired && k.Private != nil {
+			s.signer = k
+		}
+	}
+	if s.signer == nil {
+		return nil, ErrNoSigner
+	}
+
+	return s, nil
+}
+
+// Ephemeral returns a set with a single freshly generated Ed25519 key. It
+// is meant for development and tests, where tokens need not survive a
+// restart.
+func Ephemeral() (*Set, error) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	k := newKey("ephemeral", priv)
+	return &Set{keys: map[string]*Key{k.ID: k}, signer: k}, nil
+}
+
+// Generate creates a new private key of the given type ("ed25519" or
+// "rsa") and writes it to dir as <kid>.pem.
+func Generate(dir, kid, kind string) (string, error) {
+	var priv crypto.Signer
+	var err error
+	switch kind {
+	case "rsa":
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ed25519", "":
+		_, priv, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return "", fmt.Errorf("unsupported key type %q", kind)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, kid+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	return path, os.WriteFile(path, data, 0600)
+}
+
+// Signer returns the key used to sign new tokens.
+func (s *Set) Signer() *Key {
+	return s.signer
+}
+
+// Sign signs the claims with the current signing key and sets the kid
+// header so verifiers can pick the matching public key.
+func (s *Set) Sign(claims jwt.Claims) (string, error) {
+	t := jwt.NewWithClaims(s.signer.Method, claims)
+	t.Header["kid"] = s.signer.ID
+	return t.SignedString(s.signer.Private)
+}
+
+// Keyfunc resolves the verification key for a token from its kid header.
+// It can be passed straight to jwt.Parse.
+func (s *Set) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	k, ok := s.keys[kid]
+	if !ok || k.Retired {
+		return nil, ErrUnknownKey
+	}
+
+	if t.Method.Alg() != k.Method.Alg() {
+		return nil, ErrBadSigningMethod
+	}
+
+	return k.Public, nil
+}
+
+// JWKS returns the public half of every key that is still accepted.
+func (s *Set) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, kid := range s.kids() {
+		k := s.keys[kid]
+		if k.Retired {
+			continue
+		}
+		set.Keys = append(set.Keys, k.JWK())
+	}
+
+	return set
+}
+
+// JWK is the JSON Web Key representation of a public key (RFC 7517).
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public key in JWK form.
+func (k *Key) JWK() JWK {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+	}
+
+	return jwk
+}
+
+// PublicKey decodes the JWK into an RSA, ECDSA or Ed25519 public key.
+func (j JWK) PublicKey() (crypto.PublicKey, error) {
+	switch j.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(j.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(j.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(j.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+	case "OKP":
+		if j.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", j.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(j.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key size")
+		}
+		return ed25519.PublicKey(x), nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", j.Kty)
+}
+
+func (s *Set) kids() []string {
+	kids := make([]string, 0, len(s.keys))
+	for kid := range s.keys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+
+	return kids
+}
+
+func newKey(kid string, priv crypto.Signer) *Key {
+	k := &Key{ID: kid, Private: priv, Public: priv.Public()}
+	k.Method = methodFor(k.Public)
+	return k
+}
+
+func methodFor(pub crypto.PublicKey) jwt.SigningMethod {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+func parseKey(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		priv, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return signerKey(kid, priv)
+	case "RSA PRIVATE KEY":
+		priv, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return newKey(kid, priv), nil
+	case "PUBLIC KEY":
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch pub.(type) {
+		case *rsa.PublicKey, ed25519.PublicKey:
+			return &Key{ID: kid, Public: pub, Method: methodFor(pub)}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", block.Type)
+}
+
+func signerKey(kid string, priv interface{}) (*Key, error) {
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		return newKey(kid, priv), nil
+	case ed25519.PrivateKey:
+		return newKey(kid, priv), nil
+	}
+
+	return nil, errors.New("only RSA and Ed25519 keys are supported")
+}
@@ -0,0 +1,84 @@
+package keys
+
+import (
+	"crypto"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func Test_Load_Rotation(t *testing.T) {
+	dir := t.TempDir()
+	for kid, kind := range map[string]string{"2023-01": "rsa", "2023-02": "ed25519", "2023-03": "ed25519"} {
+		if _, err := Generate(dir, kid, kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set, err := Load(dir, []string{"2023-01"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if set.Signer().ID != "2023-03" {
+		t.Fatalf("expected newest key to sign, got %s", set.Signer().ID)
+	}
+
+	if n := len(set.JWKS().Keys); n != 2 {
+		t.Fatalf("expected retired key to be unpublished, got %d keys", n)
+	}
+
+	claims := jwt.MapClaims{"exp": time.Now().Add(time.Minute).Unix()}
+	pinned, err := Load(dir, nil, "2023-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := pinned.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(signed, pinned.Keyfunc); err != nil {
+		t.Fatalf("expected RS256 token to verify, got %v", err)
+	}
+	if _, err := jwt.Parse(signed, set.Keyfunc); err == nil {
+		t.Fatal("expected token signed by a retired key to be rejected")
+	}
+
+	signed, err = set.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := jwt.Parse(signed, pinned.Keyfunc); err != nil {
+		t.Fatalf("expected token signed by an older active key to verify, got %v", err)
+	}
+}
+
+func Test_JWK_PublicKey(t *testing.T) {
+	dir := t.TempDir()
+	for kid, kind := range map[string]string{"rsa": "rsa", "ed": "ed25519"} {
+		if _, err := Generate(dir, kid, kind); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	set, err := Load(dir, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, jwk := range set.JWKS().Keys {
+		pub, err := jwk.PublicKey()
+		if err != nil {
+			t.Fatalf("%s: %v", jwk.Kid, err)
+		}
+		if !set.keys[jwk.Kid].Public.(interface{ Equal(crypto.PublicKey) bool }).Equal(pub) {
+			t.Fatalf("%s: decoded key does not match", jwk.Kid)
+		}
+	}
+
+	if _, err := (JWK{Kty: "oct"}).PublicKey(); err == nil {
+		t.Fatal("expected symmetric keys to be rejected")
+	}
+}
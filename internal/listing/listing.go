@@ -0,0 +1,233 @@
+// Package listing turns filter, sort and search query parameters into a
+// pop scope. Every field has to be whitelisted in a Spec so clients can
+// never reach columns the resource does not expose.
+//
+// Supported parameters:
+//
+//	filter[email]=jane@mail.com           equality
+//	filter[created_at][gte]=2023-01-01    comparison: eq, gt, gte, lt, lte
+//	sort=-created_at,name                 "-" sorts descending
+//	q=jane                                free text over the search columns
+package listing
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/gobuffalo/validate/v3"
+)
+
+// Kind is the type of a filterable field. It decides which operators are
+// accepted and how values are parsed.
+type Kind int
+
+const (
+	String Kind = iota
+	Int
+	Time
+)
+
+var operators = map[string]string{
+	"eq":  "=",
+	"gt":  ">",
+	"gte": ">=",
+	"lt":  "<",
+	"lte": "<=",
+}
+
+var kindOperators = map[Kind][]string{
+	String: {"eq"},
+	Int:    {"eq", "gt", "gte", "lt", "lte"},
+	Time:   {"eq", "gt", "gte", "lt", "lte"},
+}
+
+var filterParam = regexp.MustCompile(`^filter\[([^\]]+)\](?:\[([^\]]+)\])?$`)
+
+// Field is a filterable column.
+type Field struct {
+	Column string
+	Kind   Kind
+	// Clause, when set, builds the condition for a parsed value instead of
+	// comparing Column, for fields that are not stored as a plain column.
+	// Its error is reported to the client.
+	Clause func(op string, value interface{}) (string, []interface{}, error)
+}
+
+// Spec whitelists what a list endpoint accepts.
+type Spec struct {
+	Filters map[string]Field
+	// Sorts maps sort names to columns.
+	Sorts map[string]string
+	// Search are the columns q is matched against.
+	Search []string
+	// DefaultSort is used when the request has no sort parameter.
+	DefaultSort string
+}
+
+type clause struct {
+	sql  string
+	args []interface{}
+}
+
+// Listing is a parsed and validated set of list parameters.
+type Listing struct {
+	wheres []clause
+	orders []string
+}
+
+// Parse validates the list parameters in values against the spec.
+// Parameters that are not filter, sort or q are ignored.
+func (s Spec) Parse(values url.Values) (*Listing, *validate.Errors) {
+	verr := validate.NewErrors()
+	l := &Listing{}
+
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		m := filterParam.FindStringSubmatch(key)
+		if m == nil {
+			continue
+		}
+
+		field, ok := s.Filters[m[1]]
+		if !ok {
+			verr.Add(key, fmt.Sprintf("%s is not a filterable field", m[1]))
+			continue
+		}
+
+		op := m[2]
+		if op == "" {
+			op = "eq"
+		}
+		if !allowed(field.Kind, op) {
+			verr.Add(key, fmt.Sprintf("%s does not support the %s operator", m[1], op))
+			continue
+		}
+
+		value, err := parseValue(field.Kind, values.Get(key))
+		if err != nil {
+			verr.Add(key, err.Error())
+			continue
+		}
+
+		c := clause{
+			sql:  fmt.Sprintf("%s %s ?", field.Column, operators[op]),
+			args: []interface{}{value},
+		}
+		if field.Clause != nil {
+			c.sql, c.args, err = field.Clause(op, value)
+			if err != nil {
+				verr.Add(key, err.Error())
+				continue
+			}
+		}
+		l.wheres = append(l.wheres, c)
+	}
+
+	if q := strings.TrimSpace(values.Get("q")); q != "" && len(s.Search) > 0 {
+		like := "%" + escapeLike(q) + "%"
+		conditions := make([]string, len(s.Search))
+		args := make([]interface{}, len(s.Search))
+		for i, column := range s.Search {
+			// LIKE is case sensitive on some databases and not on others.
+			conditions[i] = fmt.Sprintf("LOWER(%s) LIKE LOWER(?)", column)
+			args[i] = like
+		}
+		l.wheres = append(l.wheres, clause{
+			sql:  "(" + strings.Join(conditions, " OR ") + ")",
+			args: args,
+		})
+	}
+
+	sorts := values.Get("sort")
+	if sorts == "" {
+		sorts = s.DefaultSort
+	}
+	for _, name := range strings.Split(sorts, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+
+		direction := "asc"
+		if strings.HasPrefix(name, "-") {
+			direction = "desc"
+			name = name[1:]
+		}
+
+		column, ok := s.Sorts[name]
+		if !ok {
+			verr.Add("sort", fmt.Sprintf("%s is not a sortable field", name))
+			continue
+		}
+		l.orders = append(l.orders, fmt.Sprintf("%s %s", column, direction))
+	}
+
+	return l, verr
+}
+
+// Scope applies the filters and ordering to a query.
+func (l *Listing) Scope() pop.ScopeFunc {
+	return func(q *pop.Query) *pop.Query {
+		q = l.Filters()(q)
+		for _, o := range l.orders {
+			q = q.Order(o)
+		}
+		return q
+	}
+}
+
+// Filters applies only the filters and search, for callers that order
+// the query themselves.
+func (l *Listing) Filters() pop.ScopeFunc {
+	return func(q *pop.Query) *pop.Query {
+		for _, w := range l.wheres {
+			q = q.Where(w.sql, w.args...)
+		}
+		return q
+	}
+}
+
+func allowed(kind Kind, op string) bool {
+	for _, o := range kindOperators[kind] {
+		if o == op {
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseValue(kind Kind, raw string) (interface{}, error) {
+	switch kind {
+	case Int:
+		v, err := strconv.Atoi(raw)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", raw)
+		}
+		return v, nil
+	case Time:
+		for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+			if v, err := time.Parse(layout, raw); err == nil {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not a date, use YYYY-MM-DD or RFC 3339", raw)
+	}
+
+	return raw, nil
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
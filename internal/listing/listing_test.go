@@ -0,0 +1,98 @@
+package listing
+
+import (
+	"errors"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var spec = Spec{
+	Filters: map[string]Field{
+		"email":      {Column: "users.email", Kind: String},
+		"level":      {Column: "users.access_level", Kind: Int},
+		"created_at": {Column: "users.created_at", Kind: Time},
+		"color": {Kind: String, Clause: func(op string, value interface{}) (string, []interface{}, error) {
+			if value != "red" {
+				return "", nil, errors.New("only red is known")
+			}
+			return "users.color IN (?, ?)", []interface{}{"red", "crimson"}, nil
+		}},
+	},
+	Sorts:       map[string]string{"name": "users.name", "created_at": "users.created_at"},
+	Search:      []string{"users.name", "users.email"},
+	DefaultSort: "name",
+}
+
+func Test_Parse(t *testing.T) {
+	day := time.Date(2023, 1, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		query  string
+		wheres []clause
+		orders []string
+	}{
+		{"defaults", "", nil, []string{"users.name asc"}},
+		{"equality", "filter[email]=a@b.c", []clause{{"users.email = ?", []interface{}{"a@b.c"}}}, []string{"users.name asc"}},
+		{"operator", "filter[level][gte]=2", []clause{{"users.access_level >= ?", []interface{}{2}}}, []string{"users.name asc"}},
+		{
+			"date range",
+			"filter[created_at][gte]=2023-01-02&filter[created_at][lt]=2023-01-02T00:00:00Z",
+			[]clause{{"users.created_at >= ?", []interface{}{day}}, {"users.created_at < ?", []interface{}{day}}},
+			[]string{"users.name asc"},
+		},
+		{
+			"search escapes wildcards",
+			"q=50%25_off",
+			[]clause{{"(LOWER(users.name) LIKE LOWER(?) OR LOWER(users.email) LIKE LOWER(?))", []interface{}{`%50\%\_off%`, `%50\%\_off%`}}},
+			[]string{"users.name asc"},
+		},
+		{"clause", "filter[color]=red", []clause{{"users.color IN (?, ?)", []interface{}{"red", "crimson"}}}, []string{"users.name asc"}},
+		{"sort", "sort=-created_at,name", nil, []string{"users.created_at desc", "users.name asc"}},
+		{"other params are ignored", "page=2&per_page=5&fields=id", nil, []string{"users.name asc"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+			l, verr := spec.Parse(values)
+			if verr.HasAny() {
+				t.Fatalf("unexpected errors: %v", verr)
+			}
+			if len(tt.wheres) != len(l.wheres) || (len(tt.wheres) > 0 && !reflect.DeepEqual(tt.wheres, l.wheres)) {
+				t.Fatalf("wheres: expected %v, got %v", tt.wheres, l.wheres)
+			}
+			if !reflect.DeepEqual(tt.orders, l.orders) {
+				t.Fatalf("orders: expected %v, got %v", tt.orders, l.orders)
+			}
+		})
+	}
+}
+
+func Test_Parse_Rejects(t *testing.T) {
+	tests := []struct {
+		name  string
+		query string
+		key   string
+	}{
+		{"unknown filter", "filter[password]=x", "filter[password]"},
+		{"unknown operator", "filter[level][like]=1", "filter[level][like]"},
+		{"string comparison", "filter[email][gt]=a", "filter[email][gt]"},
+		{"bad number", "filter[level]=high", "filter[level]"},
+		{"bad date", "filter[created_at][gte]=yesterday", "filter[created_at][gte]"},
+		{"clause error", "filter[color]=blue", "filter[color]"},
+		{"unknown sort", "sort=-password", "sort"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			values, _ := url.ParseQuery(tt.query)
+			_, verr := spec.Parse(values)
+			if len(verr.Get(tt.key)) == 0 {
+				t.Fatalf("expected an error on %s, got %v", tt.key, verr)
+			}
+		})
+	}
+}
@@ -0,0 +1,156 @@
+// Package policy decides whether a user may perform an action on a
+// specific record. Role permissions say what a user may do in general;
+// the rules here add ownership and access level checks on top.
+package policy
+
+import (
+	"fmt"
+
+	"coke/models"
+)
+
+// Actions on users. They share their names with the permissions that
+// grant them.
+const (
+	ReadUser   = "users:read"
+	CreateUser = "users:create"
+	UpdateUser = "users:update"
+	DeleteUser = "users:delete"
+)
+
+// TopLevel is the highest access level.
+const TopLevel = 4
+
+// Denied is returned when a policy refuses an action. Reason is safe to
+// show to the caller.
+type Denied struct {
+	Reason string
+}
+
+func (d *Denied) Error() string {
+	return d.Reason
+}
+
+func deny(format string, args ...interface{}) error {
+	return &Denied{Reason: fmt.Sprintf(format, args...)}
+}
+
+// Can returns nil when actor may perform action on resource, or a
+// *Denied explaining why not. A nil resource means the action applies to
+// the collection, e.g. listing users.
+func Can(actor *models.User, action string, resource interface{}) error {
+	if actor == nil {
+		return deny("You must be signed in")
+	}
+
+	switch r := resource.(type) {
+	case nil:
+		return requirePermission(actor, action)
+	case *models.User:
+		return canUser(actor, action, r)
+	}
+
+	return deny("Unknown resource %T", resource)
+}
+
+func canUser(actor *models.User, action string, user *models.User) error {
+	self := actor.ID != 0 && actor.ID == user.ID
+
+	switch action {
+	case ReadUser:
+		if self {
+			return nil
+		}
+		return requirePermission(actor, action)
+	case CreateUser:
+		if err := requirePermission(actor, action); err != nil {
+			return err
+		}
+		if level(user) > level(actor) {
+			return deny("You can not grant an access level higher than your own")
+		}
+		return nil
+	case UpdateUser:
+		if self {
+			return nil
+		}
+		if err := requirePermission(actor, action); err != nil {
+			return err
+		}
+		if level(user) > level(actor) {
+			return deny("You can not edit a user with a higher access level than your own")
+		}
+		return nil
+	case DeleteUser:
+		if err := requirePermission(actor, action); err != nil {
+			return err
+		}
+		if level(user) > level(actor) {
+			return deny("You can not delete a user with a higher access level than your own")
+		}
+		return nil
+	}
+
+	return deny("Unknown action %s", action)
+}
+
+// CanChangeAccessLevel decides whether actor may move user to the given
+// access level. Only callers above the user may change it, except that top
+// level admins, having no one above them, manage each other. Nobody can
+// grant a level at or above their own.
+func CanChangeAccessLevel(actor, user *models.User, to int) error {
+	if actor == nil {
+		return deny("You must be signed in")
+	}
+	if err := requirePermission(actor, UpdateUser); err != nil {
+		return err
+	}
+
+	if actor.ID == user.ID {
+		return deny("You can not change your own access level")
+	}
+	if level(actor) <= level(user) && level(actor) != TopLevel {
+		return deny("You can only change the access level of users below your own")
+	}
+	if to >= level(actor) {
+		return deny("You can not grant an access level at or above your own")
+	}
+
+	return nil
+}
+
+// CanChangeStatus decides whether actor may suspend or reactivate user.
+// Nobody can change their own status or that of a user above them.
+func CanChangeStatus(actor, user *models.User) error {
+	if actor == nil {
+		return deny("You must be signed in")
+	}
+	if err := requirePermission(actor, UpdateUser); err != nil {
+		return err
+	}
+
+	if actor.ID == user.ID {
+		return deny("You can not change the status of your own account")
+	}
+	if level(user) > level(actor) {
+		return deny("You can not change the status of a user with a higher access level than your own")
+	}
+
+	return nil
+}
+
+func requirePermission(actor *models.User, permission string) error {
+	if !actor.HasPermission(permission) {
+		return deny("You do not have the %s permission", permission)
+	}
+
+	return nil
+}
+
+func level(u *models.User) int {
+	if !u.AccessLevel.Valid {
+		return 0
+	}
+
+	return u.AccessLevel.Int
+}
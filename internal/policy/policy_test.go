@@ -0,0 +1,145 @@
+package policy
+
+import (
+	"testing"
+
+	"coke/models"
+
+	"github.com/gobuffalo/nulls"
+)
+
+func user(id, lvl int, permissions ...string) *models.User {
+	return &models.User{ID: id, AccessLevel: nulls.NewInt(lvl), Permissions: permissions}
+}
+
+func Test_Can_Users(t *testing.T) {
+	member := user(1, 1)
+	viewer := user(2, 2, ReadUser)
+	editor := user(3, 3, ReadUser, CreateUser, UpdateUser)
+	admin := user(4, 4, ReadUser, CreateUser, UpdateUser, DeleteUser)
+	other := user(5, 3)
+	boss := user(6, 4)
+
+	tests := []struct {
+		name     string
+		actor    *models.User
+		action   string
+		resource interface{}
+		allowed  bool
+	}{
+		{"anonymous is denied", nil, ReadUser, nil, false},
+		{"member can not list users", member, ReadUser, nil, false},
+		{"viewer can list users", viewer, ReadUser, nil, true},
+
+		{"member can show themselves", member, ReadUser, member, true},
+		{"member can not show others", member, ReadUser, other, false},
+		{"viewer can show others", viewer, ReadUser, other, true},
+
+		{"member can update themselves", member, UpdateUser, member, true},
+		{"member can not update others", member, UpdateUser, other, false},
+		{"viewer can not update others", viewer, UpdateUser, other, false},
+		{"editor can update an equal level", editor, UpdateUser, other, true},
+		{"editor can not update a higher level", editor, UpdateUser, boss, false},
+
+		{"viewer can not create", viewer, CreateUser, user(0, 1), false},
+		{"editor can create up to their level", editor, CreateUser, user(0, 3), true},
+		{"editor can not create above their level", editor, CreateUser, user(0, 4), false},
+		{"admin can create admins", admin, CreateUser, user(0, 4), true},
+
+		{"editor can not delete", editor, DeleteUser, member, false},
+		{"admin can delete", admin, DeleteUser, other, true},
+		{"admin can delete another admin", admin, DeleteUser, boss, true},
+
+		{"unknown action is denied", admin, "users:explode", other, false},
+		{"unknown resource is denied", admin, ReadUser, "users", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Can(tt.actor, tt.action, tt.resource)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected allowed, got %v", err)
+			}
+			if !tt.allowed {
+				if _, ok := err.(*Denied); !ok {
+					t.Fatalf("expected *Denied, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func Test_CanChangeAccessLevel(t *testing.T) {
+	viewer := user(2, 2, ReadUser)
+	editor := user(3, 3, ReadUser, CreateUser, UpdateUser)
+	admin := user(4, 4, ReadUser, CreateUser, UpdateUser, DeleteUser)
+	member := user(5, 1)
+	peer := user(6, 3)
+	boss := user(7, 4)
+
+	tests := []struct {
+		name    string
+		actor   *models.User
+		user    *models.User
+		to      int
+		allowed bool
+	}{
+		{"viewer lacks the permission", viewer, member, 1, false},
+		{"editor can raise a member below their level", editor, member, 2, true},
+		{"editor can not raise to their own level", editor, member, 3, false},
+		{"editor can not change a peer", editor, peer, 1, false},
+		{"editor can not change themselves", editor, editor, 1, false},
+		{"admin can demote another admin", admin, boss, 3, true},
+		{"admin can not promote to admin", admin, peer, 4, false},
+		{"admin can not change themselves", admin, admin, 3, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CanChangeAccessLevel(tt.actor, tt.user, tt.to)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected allowed, got %v", err)
+			}
+			if !tt.allowed {
+				if _, ok := err.(*Denied); !ok {
+					t.Fatalf("expected *Denied, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func Test_CanChangeStatus(t *testing.T) {
+	viewer := user(2, 2, ReadUser)
+	editor := user(3, 3, ReadUser, CreateUser, UpdateUser)
+	member := user(5, 1)
+	peer := user(6, 3)
+	boss := user(7, 4)
+
+	tests := []struct {
+		name    string
+		actor   *models.User
+		user    *models.User
+		allowed bool
+	}{
+		{"viewer lacks the permission", viewer, member, false},
+		{"editor can suspend a member", editor, member, true},
+		{"editor can suspend a peer", editor, peer, true},
+		{"editor can not suspend a higher level", editor, boss, false},
+		{"editor can not suspend themselves", editor, editor, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CanChangeStatus(tt.actor, tt.user)
+			if tt.allowed && err != nil {
+				t.Fatalf("expected allowed, got %v", err)
+			}
+			if !tt.allowed {
+				if _, ok := err.(*Denied); !ok {
+					t.Fatalf("expected *Denied, got %v", err)
+				}
+			}
+		})
+	}
+}
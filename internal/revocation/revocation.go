@@ -0,0 +1,62 @@
+package revocation
+
+import (
+	"coke/internal/cache"
+	"coke/models"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Revoke adds the token id to the denylist until the token would have
+// expired on its own. The entry is written to the database first so that
+// it survives a restart, then cached for fast lookups. Revoking a token
+// twice, even concurrently, is not an error.
+func Revoke(jti string, exp time.Time) error {
+	revoked, err := IsRevoked(jti)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return nil
+	}
+
+	err = models.DB.Create(&models.RevokedToken{JTI: jti, ExpiresAt: exp})
+	if err != nil {
+		// A concurrent revocation may have taken the unique jti first.
+		exists, ferr := models.DB.Where("jti = ?", jti).Exists(&models.RevokedToken{})
+		if ferr != nil || !exists {
+			return err
+		}
+	}
+
+	cache.Cache.Add(getCacheKey(jti), time.Until(exp), true)
+
+	return nil
+}
+
+// IsRevoked reports whether the token id is on the denylist. The cache is
+// checked first and the database is only consulted on a miss.
+func IsRevoked(jti string) (bool, error) {
+	if cache.Cache.Exists(getCacheKey(jti)) {
+		return true, nil
+	}
+
+	rt := &models.RevokedToken{}
+	err := models.DB.Where("jti = ?", jti).First(rt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	cache.Cache.Add(getCacheKey(jti), time.Until(rt.ExpiresAt), true)
+
+	return true, nil
+}
+
+func getCacheKey(jti string) string {
+	return fmt.Sprintf("revoked:%s", jti)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"log"
 
+	"github.com/gobuffalo/pop/v6"
 	"github.com/gobuffalo/validate"
 	"github.com/gobuffalo/validate/validators"
 )
@@ -14,10 +15,18 @@ type Unique struct {
 	Field  string
 	Except int
 	Model  interface{}
+	// Tx runs the check inside a transaction, so rows it has created are
+	// seen as well. It defaults to models.DB.
+	Tx *pop.Connection
 }
 
 func (v *Unique) IsValid(errors *validate.Errors) {
-	query := models.DB.Where(fmt.Sprintf("%s = ?", v.Name), v.Field)
+	tx := v.Tx
+	if tx == nil {
+		tx = models.DB
+	}
+
+	query := tx.Where(fmt.Sprintf("%s = ?", v.Name), v.Field)
 
 	if v.Except != 0 {
 		query = query.Where("id != ?", v.Except)
@@ -0,0 +1,108 @@
+package secretbox
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// KeySize is the length of the AES-256 key a Box is built from.
+const KeySize = 32
+
+// Prefix starts every sealed value and names the format version.
+const Prefix = "v1:"
+
+var (
+	// ErrKeySize is returned when the key is not KeySize bytes long.
+	ErrKeySize = fmt.Errorf("secretbox: key must be %d bytes", KeySize)
+	// ErrMalformed is returned when a value was not sealed by a Box.
+	ErrMalformed = errors.New("secretbox: malformed sealed value")
+	// ErrOpen is returned when a value was sealed with another key or
+	// context, or has been tampered with.
+	ErrOpen = errors.New("secretbox: value can not be opened")
+)
+
+// Box encrypts small secrets for storage with AES-GCM. Each value is bound
+// to a context string, so a sealed value copied to another row does not
+// open there.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New returns a Box keyed with a KeySize byte key.
+func New(key []byte) (*Box, error) {
+	if len(key) != KeySize {
+		return nil, ErrKeySize
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Box{aead: aead}, nil
+}
+
+// Parse returns a Box keyed with a base64 encoded key.
+func Parse(encoded string) (*Box, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("secretbox: key is not valid base64: %w", err)
+	}
+
+	return New(key)
+}
+
+// Ephemeral returns a Box with a freshly generated key. It is meant for
+// development and tests, where sealed values need not survive a restart.
+func Ephemeral() (*Box, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	return New(key)
+}
+
+// Sealed reports whether the value looks like the output of Seal.
+func Sealed(value string) bool {
+	return strings.HasPrefix(value, Prefix)
+}
+
+// Seal encrypts the plaintext for the given context.
+func (b *Box) Seal(plaintext, context string) (string, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := b.aead.Seal(nonce, nonce, []byte(plaintext), []byte(context))
+	return Prefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a value sealed for the given context.
+func (b *Box) Open(value, context string) (string, error) {
+	if !Sealed(value) {
+		return "", ErrMalformed
+	}
+	data, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, Prefix))
+	if err != nil || len(data) < b.aead.NonceSize() {
+		return "", ErrMalformed
+	}
+
+	n := b.aead.NonceSize()
+	plaintext, err := b.aead.Open(nil, data[:n], data[n:], []byte(context))
+	if err != nil {
+		return "", ErrOpen
+	}
+
+	return string(plaintext), nil
+}
@@ -0,0 +1,72 @@
+package secretbox
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func Test_Seal_Open(t *testing.T) {
+	box, err := Ephemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sealed, err := box.Seal("JBSWY3DPEHPK3PXP", "totp:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !Sealed(sealed) || strings.Contains(sealed, "JBSWY3DPEHPK3PXP") {
+		t.Fatalf("expected an opaque sealed value, got %q", sealed)
+	}
+
+	again, err := box.Seal("JBSWY3DPEHPK3PXP", "totp:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == sealed {
+		t.Error("expected a fresh nonce for every seal")
+	}
+
+	plaintext, err := box.Open(sealed, "totp:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plaintext != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("expected the plaintext back, got %q", plaintext)
+	}
+
+	if _, err := box.Open(sealed, "totp:2"); !errors.Is(err, ErrOpen) {
+		t.Errorf("expected ErrOpen for another context, got %v", err)
+	}
+
+	other, err := Ephemeral()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Open(sealed, "totp:1"); !errors.Is(err, ErrOpen) {
+		t.Errorf("expected ErrOpen for another key, got %v", err)
+	}
+
+	for _, value := range []string{"JBSWY3DPEHPK3PXP", "v1:", "v1:!!!"} {
+		if _, err := box.Open(value, "totp:1"); !errors.Is(err, ErrMalformed) {
+			t.Errorf("expected ErrMalformed for %q, got %v", value, err)
+		}
+	}
+}
+
+func Test_Parse(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(make([]byte, KeySize))
+	if _, err := Parse(key); err != nil {
+		t.Fatal(err)
+	}
+
+	short := base64.StdEncoding.EncodeToString(make([]byte, 16))
+	if _, err := Parse(short); !errors.Is(err, ErrKeySize) {
+		t.Errorf("expected ErrKeySize, got %v", err)
+	}
+	if _, err := Parse("not base64"); err == nil {
+		t.Error("expected an error for a key that is not base64")
+	}
+}
@@ -0,0 +1,106 @@
+// Package sparse implements sparse fieldsets (?fields=) and embedded
+// relations (?include=) against a per-resource whitelist.
+package sparse
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gobuffalo/validate/v3"
+)
+
+// Spec whitelists the fields and includes a resource accepts. Fields are
+// JSON keys of the serialized resource; anything not listed, such as
+// hidden columns, can never be selected.
+type Spec struct {
+	Fields   []string
+	Includes []string
+}
+
+// Selection is a parsed ?fields= and ?include= pair.
+type Selection struct {
+	fields   map[string]bool
+	Includes []string
+}
+
+// Parse validates the fields and include parameters against the spec.
+func (s Spec) Parse(values url.Values) (*Selection, *validate.Errors) {
+	verr := validate.NewErrors()
+	sel := &Selection{}
+
+	for _, f := range split(values.Get("fields")) {
+		if !contains(s.Fields, f) {
+			verr.Add("fields", fmt.Sprintf("%s is not a selectable field", f))
+			continue
+		}
+		if sel.fields == nil {
+			// The id is always kept so clients can tell records apart.
+			sel.fields = map[string]bool{"id": true}
+		}
+		sel.fields[f] = true
+	}
+
+	for _, i := range split(values.Get("include")) {
+		if !contains(s.Includes, i) {
+			verr.Add("include", fmt.Sprintf("%s can not be included", i))
+			continue
+		}
+		if !contains(sel.Includes, i) {
+			sel.Includes = append(sel.Includes, i)
+		}
+	}
+
+	return sel, verr
+}
+
+// Empty reports whether the client asked for the default representation.
+func (sel *Selection) Empty() bool {
+	return sel.fields == nil && len(sel.Includes) == 0
+}
+
+// Project serializes v and keeps only the selected fields. Without a
+// fields parameter every serialized field is kept.
+func (sel *Selection) Project(v interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	if sel.fields != nil {
+		for k := range m {
+			if !sel.fields[k] {
+				delete(m, k)
+			}
+		}
+	}
+
+	return m, nil
+}
+
+func split(s string) []string {
+	out := []string{}
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+
+	return out
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,68 @@
+package sparse
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+type record struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Password string `json:"-"`
+}
+
+var spec = Spec{Fields: []string{"id", "name", "email"}, Includes: []string{"roles"}}
+
+func Test_Project(t *testing.T) {
+	r := record{ID: 1, Name: "jane", Email: "jane@mail.com", Password: "secret"}
+
+	tests := []struct {
+		query    string
+		expected map[string]interface{}
+	}{
+		{"", map[string]interface{}{"id": 1.0, "name": "jane", "email": "jane@mail.com"}},
+		{"fields=name", map[string]interface{}{"id": 1.0, "name": "jane"}},
+		{"fields=name,email&include=roles", map[string]interface{}{"id": 1.0, "name": "jane", "email": "jane@mail.com"}},
+	}
+
+	for _, tt := range tests {
+		values, _ := url.ParseQuery(tt.query)
+		sel, verr := spec.Parse(values)
+		if verr.HasAny() {
+			t.Fatalf("%s: unexpected errors %v", tt.query, verr)
+		}
+
+		m, err := sel.Project(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tt.expected, m) {
+			t.Fatalf("%s: expected %v, got %v", tt.query, tt.expected, m)
+		}
+	}
+}
+
+func Test_Parse_Rejects(t *testing.T) {
+	for query, key := range map[string]string{
+		"fields=password":       "fields",
+		"fields=name,Password":  "fields",
+		"include=organizations": "include",
+	} {
+		values, _ := url.ParseQuery(query)
+		sel, verr := spec.Parse(values)
+		if len(verr.Get(key)) == 0 {
+			t.Fatalf("%s: expected an error on %s", query, key)
+		}
+		if query == "fields=password" && !sel.Empty() {
+			t.Fatalf("%s: rejected fields must not be selected", query)
+		}
+	}
+
+	values, _ := url.ParseQuery("include=roles,roles")
+	sel, _ := spec.Parse(values)
+	if !reflect.DeepEqual([]string{"roles"}, sel.Includes) {
+		t.Fatalf("expected includes to be deduplicated, got %v", sel.Includes)
+	}
+}
@@ -0,0 +1,55 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// Test vectors from RFC 6238 appendix B, truncated to six digits.
+func Test_Code_RFC6238(t *testing.T) {
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := Code(secret, time.Unix(tt.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Errorf("at %d expected %s, got %s", tt.unix, tt.code, code)
+		}
+	}
+}
+
+func Test_Validate_Skew(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	previous, err := Code(secret, now.Add(-Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if step, ok := Validate(secret, previous, now); !ok || step != Step(now)-1 {
+		t.Fatal("expected code from the previous step to be accepted")
+	}
+
+	stale, err := Code(secret, now.Add(-3*Period*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Validate(secret, stale, now); ok {
+		t.Fatal("expected code from three steps ago to be rejected")
+	}
+}
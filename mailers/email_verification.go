@@ -0,0 +1,24 @@
+package mailers
+
+import (
+	"coke/models"
+	"fmt"
+	"net/url"
+)
+
+// SendEmailVerification emails a confirmation link to email, which is
+// either the user's address or the one they asked to change to.
+func SendEmailVerification(user *models.User, email string, token string, expiresIn string) error {
+	link := fmt.Sprintf("%s/verify-email?token=%s", appURL, url.QueryEscape(token))
+	body := fmt.Sprintf(`Hi %s,
+
+Please confirm that %s is your email address by opening the link below
+within %s:
+
+%s
+
+If you did not expect this email, you can ignore it.
+`, user.Name, email, expiresIn, link)
+
+	return Default.Send(newMessage(email, "Confirm your email address", body))
+}
@@ -0,0 +1,22 @@
+package mailers
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// SendInvitation emails a link to join an organization.
+func SendInvitation(email, organization, inviter, token, expiresIn string) error {
+	link := fmt.Sprintf("%s/invitations/accept?token=%s", appURL, url.QueryEscape(token))
+	body := fmt.Sprintf(`Hi,
+
+%s has invited you to join %s. Open the link below within %s to
+accept the invitation:
+
+%s
+
+If you were not expecting this, you can ignore this email.
+`, inviter, organization, expiresIn, link)
+
+	return Default.Send(newMessage(email, fmt.Sprintf("You have been invited to %s", organization), body))
+}
@@ -0,0 +1,62 @@
+package mailers
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/gobuffalo/buffalo/mail"
+	"github.com/gobuffalo/envy"
+)
+
+// Mailer delivers outgoing mail. mail.SMTPSender satisfies it, as does
+// Outbox.
+type Mailer interface {
+	Send(mail.Message) error
+}
+
+// Default is the mailer every email in this package is sent through.
+var Default Mailer
+
+var (
+	from   = envy.Get("MAILER_FROM", "no-reply@coke.local")
+	appURL = envy.Get("APP_URL", "http://127.0.0.1:3000")
+)
+
+func init() {
+	driver := "outbox"
+	if envy.Get("GO_ENV", "development") == "production" {
+		driver = "smtp"
+	}
+
+	var err error
+	Default, err = New(envy.Get("MAILER_DRIVER", driver))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// New builds a mailer for the given driver, "smtp" or "outbox".
+func New(driver string) (Mailer, error) {
+	switch driver {
+	case "smtp":
+		return mail.NewSMTPSender(
+			envy.Get("SMTP_HOST", "127.0.0.1"),
+			envy.Get("SMTP_PORT", "1025"),
+			envy.Get("SMTP_USER", ""),
+			envy.Get("SMTP_PASSWORD", ""),
+		)
+	case "outbox":
+		return NewOutbox(envy.Get("MAILER_OUTBOX_DIR", "tmp/outbox")), nil
+	}
+
+	return nil, fmt.Errorf("unknown mailer driver %q", driver)
+}
+
+func newMessage(to, subject, body string) mail.Message {
+	m := mail.NewMessage()
+	m.From = from
+	m.To = []string{to}
+	m.Subject = subject
+	m.Bodies = append(m.Bodies, mail.Body{Content: body, ContentType: "text/plain"})
+	return m
+}
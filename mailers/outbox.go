@@ -0,0 +1,98 @@
+package mailers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gobuffalo/buffalo/mail"
+)
+
+// Outbox writes each message to a JSON file in Dir instead of delivering
+// it. It is the default outside production and lets tests read what was
+// sent.
+type Outbox struct {
+	Dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// OutboxMessage is a message as stored in the outbox.
+type OutboxMessage struct {
+	From    string      `json:"from"`
+	To      []string    `json:"to"`
+	Subject string      `json:"subject"`
+	Bodies  []mail.Body `json:"bodies"`
+	SentAt  time.Time   `json:"sent_at"`
+}
+
+// NewOutbox returns an outbox writing to dir.
+func NewOutbox(dir string) *Outbox {
+	return &Outbox{Dir: dir}
+}
+
+// Send writes the message to the outbox directory.
+func (o *Outbox) Send(m mail.Message) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if err := os.MkdirAll(o.Dir, 0755); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(OutboxMessage{
+		From:    m.From,
+		To:      m.To,
+		Subject: m.Subject,
+		Bodies:  m.Bodies,
+		SentAt:  time.Now(),
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	o.seq++
+	name := fmt.Sprintf("%d-%04d.json", time.Now().UnixNano(), o.seq)
+	return os.WriteFile(filepath.Join(o.Dir, name), data, 0644)
+}
+
+// Messages returns every message in the outbox, oldest first.
+func (o *Outbox) Messages() ([]OutboxMessage, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	paths, err := filepath.Glob(filepath.Join(o.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	messages := make([]OutboxMessage, 0, len(paths))
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var m OutboxMessage
+		if err := json.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// Clear removes every message from the outbox.
+func (o *Outbox) Clear() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return os.RemoveAll(o.Dir)
+}
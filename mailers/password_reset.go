@@ -0,0 +1,23 @@
+package mailers
+
+import (
+	"coke/models"
+	"fmt"
+	"net/url"
+)
+
+// SendPasswordReset emails the user a link to choose a new password.
+func SendPasswordReset(user *models.User, token string, expiresIn string) error {
+	link := fmt.Sprintf("%s/reset-password?token=%s", appURL, url.QueryEscape(token))
+	body := fmt.Sprintf(`Hi %s,
+
+Someone asked to reset the password for your account. If it was you,
+open the link below within %s to choose a new password:
+
+%s
+
+If you did not ask for this, you can ignore this email.
+`, user.Name, expiresIn, link)
+
+	return Default.Send(newMessage(user.Email, "Reset your password", body))
+}
@@ -0,0 +1,66 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// AccessLevelChange records who changed a user's access level, and when.
+// ChangedBy is null once the account that made the change is purged.
+type AccessLevelChange struct {
+	ID             int          `json:"id" db:"id"`
+	UserID         int          `json:"user_id" db:"user_id"`
+	ChangedBy      nulls.Int    `json:"changed_by" db:"changed_by"`
+	OrganizationID nulls.Int    `json:"organization_id" db:"organization_id"`
+	FromLevel      nulls.Int    `json:"from_level" db:"from_level"`
+	ToLevel        int          `json:"to_level" db:"to_level"`
+	Reason         nulls.String `json:"reason" db:"reason"`
+	CreatedAt      time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time    `json:"updated_at" db:"updated_at"`
+}
+
+// AccessLevelChanges is not required by pop and may be deleted
+type AccessLevelChanges []AccessLevelChange
+
+// SetAccessLevel moves the user to a new access level and the system role
+// for it, both globally and in the organization when one is given, and
+// records the change as made by actor.
+func (u *User) SetAccessLevel(tx *pop.Connection, level int, actor *User, org *Organization, reason string) error {
+	change := &AccessLevelChange{
+		UserID:    u.ID,
+		ChangedBy: nulls.NewInt(actor.ID),
+		FromLevel: u.AccessLevel,
+		ToLevel:   level,
+	}
+	if reason != "" {
+		change.Reason = nulls.NewString(reason)
+	}
+
+	u.AccessLevel = nulls.NewInt(level)
+	if err := tx.UpdateColumns(u, "access_level"); err != nil {
+		return err
+	}
+	if err := u.AssignRole(tx); err != nil {
+		return err
+	}
+
+	if org != nil {
+		change.OrganizationID = nulls.NewInt(org.ID)
+
+		role, err := roleForLevel(tx, level)
+		if err != nil {
+			return err
+		}
+		err = tx.RawQuery(
+			"UPDATE memberships SET role_id = ?, updated_at = ? WHERE organization_id = ? AND user_id = ?",
+			role.ID, time.Now(), org.ID, u.ID,
+		).Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Create(change)
+}
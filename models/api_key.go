@@ -0,0 +1,107 @@
+package models
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"strings"
+	"time"
+
+	"coke/internal/token"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// APIKeyPrefix starts every API key so it can be told apart from a JWT.
+const APIKeyPrefix = "coke_"
+
+// APIKey is a long-lived personal access token for scripts and CI jobs.
+// The key itself is shown once on creation; only its hash is stored.
+type APIKey struct {
+	ID         int        `json:"id" db:"id"`
+	UserID     int        `json:"user_id" db:"user_id"`
+	Name       string     `json:"name" db:"name"`
+	Prefix     string     `json:"prefix" db:"prefix"`
+	TokenHash  string     `json:"-" db:"token_hash"`
+	Scopes     Scopes     `json:"scopes" db:"scopes"`
+	ExpiresAt  nulls.Time `json:"expires_at" db:"expires_at"`
+	LastUsedAt nulls.Time `json:"last_used_at" db:"last_used_at"`
+	RevokedAt  nulls.Time `json:"revoked_at" db:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// APIKeys is not required by pop and may be deleted
+type APIKeys []APIKey
+
+// NewAPIKey generates a key and returns it together with the record to
+// store for it.
+func NewAPIKey(userID int, name string, scopes []string, expiresAt nulls.Time) (string, *APIKey, error) {
+	raw, err := token.Generate(32)
+	if err != nil {
+		return "", nil, err
+	}
+
+	key := APIKeyPrefix + raw
+	return key, &APIKey{
+		UserID:    userID,
+		Name:      name,
+		Prefix:    key[:len(APIKeyPrefix)+6],
+		TokenHash: token.Hash(key),
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	}, nil
+}
+
+// FindActiveAPIKey looks up a key that is neither revoked nor expired.
+func FindActiveAPIKey(tx *pop.Connection, key string) (*APIKey, error) {
+	k := &APIKey{}
+	err := tx.Where("token_hash = ? AND revoked_at IS NULL", token.Hash(key)).
+		Where("(expires_at IS NULL OR expires_at > ?)", time.Now()).
+		First(k)
+	if err != nil {
+		return nil, err
+	}
+
+	return k, nil
+}
+
+// HasScope reports whether the key was granted scope.
+func (k *APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Scopes is stored as a comma separated list.
+type Scopes []string
+
+// Value implements driver.Valuer.
+func (s Scopes) Value() (driver.Value, error) {
+	return strings.Join(s, ","), nil
+}
+
+// Scan implements sql.Scanner.
+func (s *Scopes) Scan(src interface{}) error {
+	var v string
+	switch src := src.(type) {
+	case string:
+		v = src
+	case []byte:
+		v = string(src)
+	case nil:
+	default:
+		return fmt.Errorf("unsupported scopes type %T", src)
+	}
+
+	*s = Scopes{}
+	if v != "" {
+		*s = strings.Split(v, ",")
+	}
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/nulls"
+)
+
+// EmailVerification proves that a user controls Email. It is created when
+// an account is made and whenever the user asks to change their address.
+type EmailVerification struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	Email     string     `json:"email" db:"email"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    nulls.Time `json:"used_at" db:"used_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// EmailVerifications is not required by pop and may be deleted
+type EmailVerifications []EmailVerification
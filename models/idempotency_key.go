@@ -0,0 +1,40 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// IdempotencyKey holds the first response to a request a user sent with an
+// Idempotency-Key header, so that retries get the same answer. Status is
+// zero while the first request is still running; a request that has not
+// finished by LockedUntil is presumed dead and a retry may take over.
+type IdempotencyKey struct {
+	ID          int          `json:"id" db:"id"`
+	UserID      int          `json:"user_id" db:"user_id"`
+	KeyHash     string       `json:"-" db:"key_hash"`
+	RequestHash string       `json:"-" db:"request_hash"`
+	Status      int          `json:"status" db:"status"`
+	ContentType nulls.String `json:"content_type" db:"content_type"`
+	Body        nulls.String `json:"-" db:"body"`
+	LockedUntil nulls.Time   `json:"locked_until" db:"locked_until"`
+	ExpiresAt   time.Time    `json:"expires_at" db:"expires_at"`
+	CreatedAt   time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time    `json:"updated_at" db:"updated_at"`
+}
+
+// IdempotencyKeys is not required by pop and may be deleted
+type IdempotencyKeys []IdempotencyKey
+
+// Done reports whether the first response has been stored.
+func (k *IdempotencyKey) Done() bool {
+	return k.Status != 0
+}
+
+// PurgeExpiredIdempotencyKeys removes the keys that stopped being replayed
+// before the given time and returns how many were removed.
+func PurgeExpiredIdempotencyKeys(tx *pop.Connection, before time.Time) (int, error) {
+	return tx.RawQuery("DELETE FROM idempotency_keys WHERE expires_at < ?", before).ExecWithCount()
+}
@@ -0,0 +1,33 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// Invitation asks someone to join an organization with a given role. The
+// token is emailed to them and only its hash is stored.
+type Invitation struct {
+	ID             int        `json:"id" db:"id"`
+	OrganizationID int        `json:"organization_id" db:"organization_id"`
+	Email          string     `json:"email" db:"email"`
+	RoleID         int        `json:"role_id" db:"role_id"`
+	InvitedBy      nulls.Int  `json:"invited_by" db:"invited_by"`
+	TokenHash      string     `json:"-" db:"token_hash"`
+	ExpiresAt      time.Time  `json:"expires_at" db:"expires_at"`
+	AcceptedAt     nulls.Time `json:"accepted_at" db:"accepted_at"`
+	RevokedAt      nulls.Time `json:"revoked_at" db:"revoked_at"`
+	CreatedAt      time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// Invitations is not required by pop and may be deleted
+type Invitations []Invitation
+
+// PendingInvitation scopes a query to invitations that can still be
+// accepted.
+func PendingInvitation(q *pop.Query) *pop.Query {
+	return q.Where("accepted_at IS NULL AND revoked_at IS NULL AND expires_at > ?", time.Now())
+}
@@ -0,0 +1,140 @@
+package models
+
+import (
+	"database/sql"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+	"github.com/pkg/errors"
+)
+
+// Organization is a tenant. Users only see and manage the members of the
+// organization their request acts in.
+type Organization struct {
+	ID        int       `json:"id" db:"id"`
+	Name      string    `json:"name" db:"name"`
+	Slug      string    `json:"slug" db:"slug"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Organizations is not required by pop and may be deleted
+type Organizations []Organization
+
+// Membership puts a user in an organization with a role that decides
+// their permissions there.
+type Membership struct {
+	ID             int       `json:"id" db:"id"`
+	OrganizationID int       `json:"organization_id" db:"organization_id"`
+	UserID         int       `json:"user_id" db:"user_id"`
+	RoleID         int       `json:"role_id" db:"role_id"`
+	CreatedAt      time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Memberships is not required by pop and may be deleted
+type Memberships []Membership
+
+var nonSlug = regexp.MustCompile(`[^a-z0-9]+`)
+
+// Slugify turns an organization name into its URL friendly slug.
+func Slugify(name string) string {
+	return strings.Trim(nonSlug.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
+// AddMember adds the user to the organization with the system role for
+// their access level, or the lowest one if they have none.
+func AddMember(tx *pop.Connection, organizationID int, user *User) error {
+	level := 1
+	if user.AccessLevel.Valid {
+		level = user.AccessLevel.Int
+	}
+
+	role, err := roleForLevel(tx, level)
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&Membership{OrganizationID: organizationID, UserID: user.ID, RoleID: role.ID})
+}
+
+// roleForLevel returns the system role with the highest level not above
+// the given one.
+func roleForLevel(tx *pop.Connection, level int) (*Role, error) {
+	role := &Role{}
+	err := tx.Where("level <= ?", level).Order("level desc").First(role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, errors.New("no role to assign, have the roles been seeded?")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return role, nil
+}
+
+// FindMemberOrganization returns the organization if the user belongs to
+// it. An id of 0 picks the first organization the user belongs to.
+func FindMemberOrganization(tx *pop.Connection, userID, organizationID int) (*Organization, error) {
+	org := &Organization{}
+	q := tx.Where("id IN (SELECT organization_id FROM memberships WHERE user_id = ?)", userID)
+	if organizationID != 0 {
+		q = q.Where("id = ?", organizationID)
+	}
+
+	err := q.Order("id asc").First(org)
+	if err != nil {
+		return nil, err
+	}
+
+	return org, nil
+}
+
+// MemberOf scopes a users query to the members of an organization.
+func MemberOf(organizationID int) pop.ScopeFunc {
+	return func(q *pop.Query) *pop.Query {
+		return q.Where("users.id IN (SELECT user_id FROM memberships WHERE organization_id = ?)", organizationID)
+	}
+}
+
+// SharedOrganizations returns, keyed by user id, the organizations each
+// user belongs to that the viewer is a member of as well. Memberships the
+// viewer can not see are left out.
+func SharedOrganizations(tx *pop.Connection, viewerID int, userIDs []int) (map[int]Organizations, error) {
+	byUser := map[int]Organizations{}
+	if len(userIDs) == 0 {
+		return byUser, nil
+	}
+
+	memberships := Memberships{}
+	err := tx.Where("organization_id IN (SELECT organization_id FROM memberships WHERE user_id = ?)", viewerID).
+		Where("user_id IN (?)", inArgs(userIDs)...).All(&memberships)
+	if err != nil {
+		return nil, err
+	}
+	if len(memberships) == 0 {
+		return byUser, nil
+	}
+
+	ids := []int{}
+	for _, m := range memberships {
+		ids = append(ids, m.OrganizationID)
+	}
+
+	orgs := Organizations{}
+	err = tx.Where("id IN (?)", inArgs(ids)...).Order("id asc").All(&orgs)
+	if err != nil {
+		return nil, err
+	}
+	for _, org := range orgs {
+		for _, m := range memberships {
+			if m.OrganizationID == org.ID {
+				byUser[m.UserID] = append(byUser[m.UserID], org)
+			}
+		}
+	}
+
+	return byUser, nil
+}
@@ -0,0 +1,22 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/nulls"
+)
+
+// PasswordReset is a single-use token emailed to a user who forgot their
+// password. Only the hash of the token is stored.
+type PasswordReset struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	UsedAt    nulls.Time `json:"used_at" db:"used_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// PasswordResets is not required by pop and may be deleted
+type PasswordResets []PasswordReset
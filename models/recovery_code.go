@@ -0,0 +1,69 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"coke/internal/token"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// RecoveryCodeCount is how many recovery codes are issued at a time.
+const RecoveryCodeCount = 10
+
+// RecoveryCode is a one-time code that can stand in for a TOTP code when
+// the user has lost their authenticator.
+type RecoveryCode struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	CodeHash  string     `json:"-" db:"code_hash"`
+	UsedAt    nulls.Time `json:"used_at" db:"used_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// RecoveryCodes is not required by pop and may be deleted
+type RecoveryCodes []RecoveryCode
+
+// GenerateRecoveryCodes replaces the user's recovery codes with a fresh
+// set and returns the plain codes. They can not be retrieved again.
+func GenerateRecoveryCodes(tx *pop.Connection, userID int) ([]string, error) {
+	err := tx.RawQuery("DELETE FROM recovery_codes WHERE user_id = ?", userID).Exec()
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, RecoveryCodeCount)
+	for i := range codes {
+		raw, err := token.Generate(8)
+		if err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(raw[:5] + "-" + raw[5:10])
+
+		err = tx.Create(&RecoveryCode{UserID: userID, CodeHash: token.Hash(code)})
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code
+	}
+
+	return codes, nil
+}
+
+// UseRecoveryCode marks a matching unused code as used. It reports false
+// when no such code exists.
+func UseRecoveryCode(tx *pop.Connection, userID int, code string) (bool, error) {
+	code = strings.ToLower(strings.TrimSpace(code))
+	n, err := tx.RawQuery(
+		"UPDATE recovery_codes SET used_at = ? WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		time.Now(), userID, token.Hash(code),
+	).ExecWithCount()
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
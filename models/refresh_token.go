@@ -0,0 +1,46 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// RefreshToken is an opaque, single-use credential that can be exchanged
+// for a new access token. Tokens issued from the same login share a
+// FamilyID so that the whole chain can be revoked at once.
+type RefreshToken struct {
+	ID        int        `json:"id" db:"id"`
+	UserID    int        `json:"user_id" db:"user_id"`
+	TokenHash string     `json:"-" db:"token_hash"`
+	FamilyID  string     `json:"-" db:"family_id"`
+	ExpiresAt time.Time  `json:"expires_at" db:"expires_at"`
+	RevokedAt nulls.Time `json:"revoked_at" db:"revoked_at"`
+	CreatedAt time.Time  `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at" db:"updated_at"`
+}
+
+// RefreshTokens is not required by pop and may be deleted
+type RefreshTokens []RefreshToken
+
+// IsExpired reports whether the token can no longer be exchanged.
+func (t *RefreshToken) IsExpired() bool {
+	return time.Now().After(t.ExpiresAt)
+}
+
+// RevokeFamily revokes every token that was rotated from the same login.
+func (t *RefreshToken) RevokeFamily(tx *pop.Connection) error {
+	return tx.RawQuery(
+		"UPDATE refresh_tokens SET revoked_at = ? WHERE family_id = ? AND revoked_at IS NULL",
+		time.Now(), t.FamilyID,
+	).Exec()
+}
+
+// RevokeUserRefreshTokens revokes every outstanding refresh token of a user.
+func RevokeUserRefreshTokens(tx *pop.Connection, userID int) error {
+	return tx.RawQuery(
+		"UPDATE refresh_tokens SET revoked_at = ? WHERE user_id = ? AND revoked_at IS NULL",
+		time.Now(), userID,
+	).Exec()
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gobuffalo/pop/v6"
+)
+
+// RevokedToken records the jti of an access token that must no longer be
+// accepted, even though its signature and expiry are still valid.
+type RevokedToken struct {
+	ID        int       `json:"id" db:"id"`
+	JTI       string    `json:"jti" db:"jti"`
+	ExpiresAt time.Time `json:"expires_at" db:"expires_at"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// RevokedTokens is not required by pop and may be deleted
+type RevokedTokens []RevokedToken
+
+// PurgeExpiredRevokedTokens removes the denylist entries of tokens that
+// expired before the given time and returns how many were removed.
+func PurgeExpiredRevokedTokens(tx *pop.Connection, before time.Time) (int, error) {
+	return tx.RawQuery("DELETE FROM revoked_tokens WHERE expires_at < ?", before).ExecWithCount()
+}
@@ -0,0 +1,18 @@
+package models
+
+import (
+	"time"
+)
+
+func (ms *ModelSuite) Test_PurgeExpiredRevokedTokens() {
+	ms.NoError(ms.DB.Create(&RevokedToken{JTI: "live", ExpiresAt: time.Now().Add(time.Hour)}))
+	ms.NoError(ms.DB.Create(&RevokedToken{JTI: "expired", ExpiresAt: time.Now().Add(-time.Hour)}))
+
+	n, err := PurgeExpiredRevokedTokens(ms.DB, time.Now())
+	ms.NoError(err)
+	ms.Equal(1, n)
+
+	exists, err := ms.DB.Where("jti = ?", "live").Exists(&RevokedToken{})
+	ms.NoError(err)
+	ms.True(exists)
+}
@@ -0,0 +1,255 @@
+package models
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+	"github.com/pkg/errors"
+)
+
+// Role is a named set of permissions. Roles with a Level are the system
+// roles that access levels map onto; a user holds exactly one of those.
+type Role struct {
+	ID          int       `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Level       nulls.Int `json:"level" db:"level"`
+	Description string    `json:"description" db:"description"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Roles is not required by pop and may be deleted
+type Roles []Role
+
+// Permission is a single action that can be granted, e.g. "users:delete".
+// Permission names double as API key scopes.
+type Permission struct {
+	ID          int       `json:"id" db:"id"`
+	Name        string    `json:"name" db:"name"`
+	Description string    `json:"description" db:"description"`
+	CreatedAt   time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// Permissions is not required by pop and may be deleted
+type Permissions []Permission
+
+// RolePermission grants a permission to a role.
+type RolePermission struct {
+	ID           int       `json:"id" db:"id"`
+	RoleID       int       `json:"role_id" db:"role_id"`
+	PermissionID int       `json:"permission_id" db:"permission_id"`
+	CreatedAt    time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// UserRole assigns a role to a user.
+type UserRole struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	RoleID    int       `json:"role_id" db:"role_id"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// DefaultRole describes a system role and the permissions it is granted.
+type DefaultRole struct {
+	Name        string
+	Level       int
+	Description string
+	Permissions []string
+}
+
+// DefaultPermissions and DefaultRoles are what the seed_roles migration
+// inserts. Keep the two in step.
+var (
+	DefaultPermissions = map[string]string{
+		"users:read":   "List and view users",
+		"users:create": "Create users",
+		"users:update": "Edit users",
+		"users:delete": "Delete users",
+	}
+	DefaultRoles = []DefaultRole{
+		{"member", 1, "Signed in user without access to other accounts", nil},
+		{"viewer", 2, "Read only access to users", []string{"users:read"}},
+		{"editor", 3, "Manage users without deleting them", []string{"users:read", "users:create", "users:update"}},
+		{"admin", 4, "Full access", []string{"users:read", "users:create", "users:update", "users:delete"}},
+	}
+)
+
+// SeedRoles creates any missing default roles and permissions. It is safe
+// to run against a database the migration has already seeded.
+func SeedRoles(tx *pop.Connection) error {
+	permissions := map[string]int{}
+	for name, description := range DefaultPermissions {
+		p := &Permission{}
+		err := tx.Where("name = ?", name).First(p)
+		if errors.Is(err, sql.ErrNoRows) {
+			p = &Permission{Name: name, Description: description}
+			err = tx.Create(p)
+		}
+		if err != nil {
+			return err
+		}
+		permissions[name] = p.ID
+	}
+
+	for _, dr := range DefaultRoles {
+		role := &Role{}
+		err := tx.Where("name = ?", dr.Name).First(role)
+		if errors.Is(err, sql.ErrNoRows) {
+			role = &Role{Name: dr.Name, Level: nulls.NewInt(dr.Level), Description: dr.Description}
+			err = tx.Create(role)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, name := range dr.Permissions {
+			exists, err := tx.Where("role_id = ? AND permission_id = ?", role.ID, permissions[name]).Exists(&RolePermission{})
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+			err = tx.Create(&RolePermission{RoleID: role.ID, PermissionID: permissions[name]})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// AssignRole gives the user the system role matching their access level,
+// replacing any system role they held before. Other roles are kept.
+func (u *User) AssignRole(tx *pop.Connection) error {
+	err := tx.RawQuery(
+		"DELETE FROM user_roles WHERE user_id = ? AND role_id IN (SELECT id FROM roles WHERE level IS NOT NULL)",
+		u.ID,
+	).Exec()
+	if err != nil {
+		return err
+	}
+
+	if !u.AccessLevel.Valid {
+		return nil
+	}
+
+	role := &Role{}
+	err = tx.Where("level = ?", u.AccessLevel.Int).First(role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return tx.Create(&UserRole{UserID: u.ID, RoleID: role.ID})
+}
+
+// LoadPermissions fills Permissions from the user's role in the
+// organization, or from their own roles when org is nil.
+func (u *User) LoadPermissions(tx *pop.Connection, org *Organization) error {
+	permissions := []string{}
+	q := tx.RawQuery(
+		`SELECT DISTINCT p.name FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		JOIN user_roles ur ON ur.role_id = rp.role_id
+		WHERE ur.user_id = ?`,
+		u.ID,
+	)
+	if org != nil {
+		q = tx.RawQuery(
+			`SELECT DISTINCT p.name FROM permissions p
+			JOIN role_permissions rp ON rp.permission_id = p.id
+			JOIN memberships m ON m.role_id = rp.role_id
+			WHERE m.user_id = ? AND m.organization_id = ?`,
+			u.ID, org.ID,
+		)
+	}
+
+	err := q.All(&permissions)
+	if err != nil {
+		return err
+	}
+
+	u.Permissions = permissions
+	return nil
+}
+
+// HasPermission reports whether one of the user's roles grants permission.
+// Permissions must have been loaded with LoadPermissions.
+func (u *User) HasPermission(permission string) bool {
+	for _, p := range u.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RolesForUsers returns the roles of each user keyed by user id: their
+// role in the organization, or their own roles when org is nil.
+func RolesForUsers(tx *pop.Connection, org *Organization, userIDs []int) (map[int]Roles, error) {
+	byUser := map[int]Roles{}
+	if len(userIDs) == 0 {
+		return byUser, nil
+	}
+
+	roleIDs := map[int][]int{}
+	if org != nil {
+		memberships := Memberships{}
+		err := tx.Where("organization_id = ?", org.ID).Where("user_id IN (?)", inArgs(userIDs)...).All(&memberships)
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range memberships {
+			roleIDs[m.RoleID] = append(roleIDs[m.RoleID], m.UserID)
+		}
+	} else {
+		userRoles := []UserRole{}
+		err := tx.Where("user_id IN (?)", inArgs(userIDs)...).All(&userRoles)
+		if err != nil {
+			return nil, err
+		}
+		for _, ur := range userRoles {
+			roleIDs[ur.RoleID] = append(roleIDs[ur.RoleID], ur.UserID)
+		}
+	}
+	if len(roleIDs) == 0 {
+		return byUser, nil
+	}
+
+	ids := []int{}
+	for id := range roleIDs {
+		ids = append(ids, id)
+	}
+
+	roles := Roles{}
+	err := tx.Where("id IN (?)", inArgs(ids)...).Order("id asc").All(&roles)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		for _, userID := range roleIDs[role.ID] {
+			byUser[userID] = append(byUser[userID], role)
+		}
+	}
+
+	return byUser, nil
+}
+
+// inArgs spreads ids into the arguments of an "IN (?)" clause.
+func inArgs(ids []int) []interface{} {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return args
+}
@@ -0,0 +1,26 @@
+package models
+
+import (
+	"github.com/gobuffalo/nulls"
+)
+
+func (ms *ModelSuite) Test_User_AssignRole() {
+	ms.NoError(SeedRoles(ms.DB))
+	// Seeding twice must not duplicate anything.
+	ms.NoError(SeedRoles(ms.DB))
+
+	user := &User{Name: "user", Email: "user@mail.com", Password: "password", AccessLevel: nulls.NewInt(2)}
+	ms.NoError(ms.DB.Create(user))
+
+	ms.NoError(user.LoadPermissions(ms.DB, nil))
+	ms.Equal([]string{"users:read"}, user.Permissions)
+
+	user.AccessLevel = nulls.NewInt(4)
+	ms.NoError(user.AssignRole(ms.DB))
+	ms.NoError(user.LoadPermissions(ms.DB, nil))
+	ms.True(user.HasPermission("users:delete"))
+
+	count, err := ms.DB.Where("user_id = ?", user.ID).Count(&UserRole{})
+	ms.NoError(err)
+	ms.Equal(1, count)
+}
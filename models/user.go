@@ -1,6 +1,9 @@
 package models
 
 import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
 	"time"
 
 	"github.com/gobuffalo/nulls"
@@ -12,32 +15,154 @@ import (
 
 // User is used by pop to map your users database table to your go code.
 type User struct {
-	ID                   int       `json:"id" db:"id"`
-	Name                 string    `json:"name" form:"name" db:"name"`
-	Email                string    `json:"email" form:"email" db:"email"`
-	Password             string    `json:"-" form:"password" db:"password"`
-	PasswordConfirmation string    `json:"-" form:"password_confirmation" db:"-"`
-	AccessLevel          nulls.Int `json:"access_level" db:"access_level"`
-	CreatedAt            time.Time `json:"created_at" db:"created_at"`
-	UpdatedAt            time.Time `json:"updated_at" db:"updated_at"`
+	ID                   int          `json:"id" db:"id"`
+	Name                 string       `json:"name" form:"name" db:"name"`
+	Email                string       `json:"email" form:"email" db:"email"`
+	Password             string       `json:"-" form:"password" db:"password"`
+	PasswordConfirmation string       `json:"-" form:"password_confirmation" db:"-"`
+	AccessLevel          nulls.Int    `json:"access_level" db:"access_level"`
+	TOTPSecret           nulls.String `json:"-" db:"totp_secret"`
+	TOTPEnabledAt        nulls.Time   `json:"two_factor_enabled_at" db:"totp_enabled_at"`
+	VerifiedAt           nulls.Time   `json:"verified_at" db:"verified_at"`
+	PendingEmail         nulls.String `json:"pending_email" db:"pending_email"`
+	CreatedAt            time.Time    `json:"created_at" db:"created_at"`
+	UpdatedAt            time.Time    `json:"updated_at" db:"updated_at"`
+	DeletedAt            nulls.Time   `json:"deleted_at" db:"deleted_at"`
+	Preferences          Preferences  `json:"-" db:"preferences"`
+	TokensValidAfter     nulls.Time   `json:"-" db:"tokens_valid_after"`
+	Status               string       `json:"status" db:"status"`
+	StatusReason         nulls.String `json:"status_reason" db:"status_reason"`
+	StatusUntil          nulls.Time   `json:"status_until" db:"status_until"`
+	Permissions          []string     `json:"-" db:"-"`
 }
 
 // Users is not required by pop and may be deleted
 type Users []User
 
+// Preferences are free-form settings users keep for themselves, stored as
+// a JSON object.
+type Preferences map[string]interface{}
+
+// Value implements driver.Valuer.
+func (p Preferences) Value() (driver.Value, error) {
+	if len(p) == 0 {
+		return nil, nil
+	}
+
+	b, err := json.Marshal(p)
+	return string(b), err
+}
+
+// Scan implements sql.Scanner.
+func (p *Preferences) Scan(src interface{}) error {
+	var v []byte
+	switch src := src.(type) {
+	case string:
+		v = []byte(src)
+	case []byte:
+		v = src
+	case nil:
+	default:
+		return fmt.Errorf("unsupported preferences type %T", src)
+	}
+
+	*p = Preferences{}
+	if len(v) == 0 {
+		return nil
+	}
+	return json.Unmarshal(v, p)
+}
+
 func (u *User) BeforeCreate(tx *pop.Connection) error {
+	if u.Status == "" {
+		u.Status = StatusActive
+	}
 
 	// Hash the string password
-	hashed, err := bcrypt.GenerateFromPassword([]byte(u.Password), bcrypt.DefaultCost)
+	hashed, err := HashPassword(u.Password)
 	if err != nil {
-		return errors.WithStack(err)
+		return err
 	}
 
-	u.Password = string(hashed)
+	u.Password = hashed
 
 	return nil
 }
 
+// AfterCreate gives new users the role for their access level.
+func (u *User) AfterCreate(tx *pop.Connection) error {
+	return u.AssignRole(tx)
+}
+
+// NotDeleted scopes a users query to accounts that have not been soft
+// deleted. Every lookup of a user acting on the API must use it.
+func NotDeleted(q *pop.Query) *pop.Query {
+	return q.Where("users.deleted_at IS NULL")
+}
+
+// OnlyDeleted scopes a users query to soft deleted accounts.
+func OnlyDeleted(q *pop.Query) *pop.Query {
+	return q.Where("users.deleted_at IS NOT NULL")
+}
+
+// SoftDelete marks the user as deleted, keeping the row so it can be
+// restored until it is purged.
+func (u *User) SoftDelete(tx *pop.Connection) error {
+	u.DeletedAt = nulls.NewTime(time.Now())
+	return tx.UpdateColumns(u, "deleted_at")
+}
+
+// Restore undoes SoftDelete.
+func (u *User) Restore(tx *pop.Connection) error {
+	u.DeletedAt = nulls.Time{}
+	return tx.UpdateColumns(u, "deleted_at")
+}
+
+// PurgeDeletedUsers permanently removes users soft deleted before the given
+// time and returns how many were removed.
+func PurgeDeletedUsers(tx *pop.Connection, before time.Time) (int, error) {
+	return tx.RawQuery("DELETE FROM users WHERE deleted_at IS NOT NULL AND deleted_at < ?", before).ExecWithCount()
+}
+
+// HashPassword returns the bcrypt hash stored in the password column.
+func HashPassword(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return "", errors.WithStack(err)
+	}
+
+	return string(hashed), nil
+}
+
+// ChangePassword hashes and stores a new password for the user.
+func (u *User) ChangePassword(tx *pop.Connection, password string) error {
+	hashed, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	u.Password = hashed
+	return tx.UpdateColumns(u, "password")
+}
+
+// RevokeTokens makes every access token issued to the user so far invalid.
+// The cutoff has a one second resolution, matching the iat claim.
+func (u *User) RevokeTokens(tx *pop.Connection) error {
+	u.TokensValidAfter = nulls.NewTime(time.Now().Truncate(time.Second))
+	return tx.UpdateColumns(u, "tokens_valid_after")
+}
+
+// TokenRevoked reports whether an access token issued at iat predates
+// RevokeTokens.
+func (u *User) TokenRevoked(iat time.Time) bool {
+	return u.TokensValidAfter.Valid && iat.Before(u.TokensValidAfter.Time)
+}
+
+// TwoFactorEnabled reports whether the user has confirmed a TOTP secret.
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTPEnabledAt.Valid
+}
+
 // Validate gets run every time you call a "pop.Validate*" (pop.ValidateAndSave, pop.ValidateAndCreate, pop.ValidateAndUpdate) method.
 // This method is not required and may be deleted.
 func (u *User) Validate(tx *pop.Connection) (*validate.Errors, error) {
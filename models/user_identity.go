@@ -0,0 +1,21 @@
+package models
+
+import (
+	"time"
+)
+
+// UserIdentity links a user to their account at an external identity
+// provider. Subject is the provider's stable id for the user; Email is
+// what the provider last reported and is informational only.
+type UserIdentity struct {
+	ID        int       `json:"id" db:"id"`
+	UserID    int       `json:"user_id" db:"user_id"`
+	Provider  string    `json:"provider" db:"provider"`
+	Subject   string    `json:"subject" db:"subject"`
+	Email     string    `json:"email" db:"email"`
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
+}
+
+// UserIdentities is not required by pop and may be deleted
+type UserIdentities []UserIdentity
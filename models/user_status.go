@@ -0,0 +1,106 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// Account statuses. Only active users can sign in. Pending accounts wait
+// for their email to be verified and suspended ones were stopped by an
+// admin; neither can use the tokens they already hold. Locked accounts had
+// too many failed sign ins and keep their existing sessions.
+const (
+	StatusPending   = "pending"
+	StatusActive    = "active"
+	StatusSuspended = "suspended"
+	StatusLocked    = "locked"
+)
+
+// statusTransitions lists the statuses each status can move to.
+var statusTransitions = map[string][]string{
+	StatusPending:   {StatusActive, StatusSuspended},
+	StatusActive:    {StatusSuspended, StatusLocked},
+	StatusSuspended: {StatusActive},
+	StatusLocked:    {StatusActive, StatusSuspended},
+}
+
+// StatusTransitionError is returned when a user can not move from their
+// current status to the requested one.
+type StatusTransitionError struct {
+	From, To string
+}
+
+func (e *StatusTransitionError) Error() string {
+	return fmt.Sprintf("A %s account can not become %s", e.From, e.To)
+}
+
+// ValidStatus reports whether status is one of the account statuses.
+func ValidStatus(status string) bool {
+	_, ok := statusTransitions[status]
+	return ok
+}
+
+// CanTransition reports whether an account may move from one status to
+// another.
+func CanTransition(from, to string) bool {
+	for _, status := range statusTransitions[from] {
+		if status == to {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetStatus moves the user to a new status. A valid until makes the
+// status lapse back to active at that time.
+func (u *User) SetStatus(tx *pop.Connection, status, reason string, until nulls.Time) error {
+	if !CanTransition(u.Status, status) {
+		return &StatusTransitionError{From: u.Status, To: status}
+	}
+
+	u.Status = status
+	u.StatusReason = nulls.String{}
+	if reason != "" {
+		u.StatusReason = nulls.NewString(reason)
+	}
+	u.StatusUntil = until
+	return tx.UpdateColumns(u, "status", "status_reason", "status_until")
+}
+
+// Active reports whether the user may sign in.
+func (u *User) Active() bool {
+	return u.Status == StatusActive
+}
+
+// KeepsSessions reports whether the user's existing tokens and API keys
+// are still accepted. A lock only stops new sign ins, otherwise anyone who
+// knows an email could sign its owner out.
+func (u *User) KeepsSessions() bool {
+	return u.Status == StatusActive || u.Status == StatusLocked
+}
+
+// AfterFind lifts statuses that have lapsed, so every loaded user shows the
+// status in force rather than the one stored.
+func (u *User) AfterFind(tx *pop.Connection) error {
+	if u.StatusUntil.Valid && !time.Now().Before(u.StatusUntil.Time) {
+		u.Status = StatusActive
+		u.StatusReason = nulls.String{}
+		u.StatusUntil = nulls.Time{}
+	}
+
+	return nil
+}
+
+// StatusCondition returns the SQL condition matching users whose status in
+// force is the given one at now, treating lapsed statuses as active.
+func StatusCondition(status string, now time.Time) (string, []interface{}) {
+	if status == StatusActive {
+		return "(users.status = ? OR users.status_until <= ?)", []interface{}{status, now}
+	}
+
+	return "(users.status = ? AND (users.status_until IS NULL OR users.status_until > ?))", []interface{}{status, now}
+}
@@ -0,0 +1,29 @@
+package models
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/gobuffalo/nulls"
+)
+
+func (ms *ModelSuite) Test_PurgeDeletedUsers() {
+	ms.NoError(SeedRoles(ms.DB))
+
+	for i, deletedAt := range []nulls.Time{{}, nulls.NewTime(time.Now()), nulls.NewTime(time.Now().AddDate(0, 0, -40))} {
+		user := &User{Name: "user", Email: fmt.Sprintf("user%d@mail.com", i), Password: "password", DeletedAt: deletedAt}
+		ms.NoError(ms.DB.Create(user))
+	}
+
+	n, err := PurgeDeletedUsers(ms.DB, time.Now().AddDate(0, 0, -30))
+	ms.NoError(err)
+	ms.Equal(1, n)
+
+	count, err := ms.DB.Count(&User{})
+	ms.NoError(err)
+	ms.Equal(2, count)
+
+	count, err = ms.DB.Scope(NotDeleted).Count(&User{})
+	ms.NoError(err)
+	ms.Equal(1, count)
+}
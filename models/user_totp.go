@@ -0,0 +1,59 @@
+package models
+
+import (
+	"coke/internal/secretbox"
+	"fmt"
+
+	"github.com/gobuffalo/nulls"
+	"github.com/gobuffalo/pop/v6"
+)
+
+// totpContext binds a sealed TOTP secret to its user, so the value can not
+// be moved to another account.
+func (u *User) totpContext() string {
+	return fmt.Sprintf("totp:%d", u.ID)
+}
+
+// SealTOTPSecret encrypts the secret with the box and sets it on the user.
+// It is not saved.
+func (u *User) SealTOTPSecret(box *secretbox.Box, secret string) error {
+	sealed, err := box.Seal(secret, u.totpContext())
+	if err != nil {
+		return err
+	}
+
+	u.TOTPSecret = nulls.NewString(sealed)
+	return nil
+}
+
+// OpenTOTPSecret returns the user's TOTP secret in the clear. Secrets
+// stored before encryption was introduced are returned as they are.
+func (u *User) OpenTOTPSecret(box *secretbox.Box) (string, error) {
+	if !secretbox.Sealed(u.TOTPSecret.String) {
+		return u.TOTPSecret.String, nil
+	}
+
+	return box.Open(u.TOTPSecret.String, u.totpContext())
+}
+
+// EncryptTOTPSecrets seals every TOTP secret still stored in the clear and
+// returns how many were sealed.
+func EncryptTOTPSecrets(tx *pop.Connection, box *secretbox.Box) (int, error) {
+	users := Users{}
+	err := tx.Where("totp_secret IS NOT NULL AND totp_secret NOT LIKE ?", secretbox.Prefix+"%").All(&users)
+	if err != nil {
+		return 0, err
+	}
+
+	for i := range users {
+		user := &users[i]
+		if err := user.SealTOTPSecret(box, user.TOTPSecret.String); err != nil {
+			return i, err
+		}
+		if err := tx.UpdateColumns(user, "totp_secret"); err != nil {
+			return i, err
+		}
+	}
+
+	return len(users), nil
+}